@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// allowNets, when set and not empty, are the only client networks that may query the server.
+	// It's swapped whole when -allow-file is reloaded.
+	allowNets atomic.Pointer[[]*net.IPNet]
+	// denyNets are client networks that are always refused, even if allowed
+	denyNets []*net.IPNet
+)
+
+// parseCIDRList parses a comma separated list of CIDRs, a bare IP is treated as a single address
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// loadAllowFile reads the networks in path, one CIDR or IP per line, skipping blank lines and lines starting
+// with #. A file without any is an error rather than an empty allow list, which would let every client in.
+func loadAllowFile(path string) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lineNets, err := parseCIDRList(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		nets = append(nets, lineNets...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(nets) == 0 {
+		return nil, errors.New("no networks")
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed reports whether a client may use the server, deny takes precedence over allow
+// and when no allow list is configured every client not denied is allowed
+func clientAllowed(client string) bool {
+	var allow []*net.IPNet
+	if nets := allowNets.Load(); nets != nil {
+		allow = *nets
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return len(allow) == 0 && len(denyNets) == 0
+	}
+	if containsIP(denyNets, ip) {
+		return false
+	}
+	return len(allow) == 0 || containsIP(allow, ip)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// mustParseCIDRList parses list, failing the test if it's invalid
+func mustParseCIDRList(t *testing.T, list string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseCIDRList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+// useAllowNets sets the allow list for the duration of the test
+func useAllowNets(t *testing.T, nets []*net.IPNet) {
+	t.Helper()
+	old := allowNets.Load()
+	allowNets.Store(&nets)
+	t.Cleanup(func() { allowNets.Store(old) })
+}
+
+func TestClientAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name, allow, deny string
+		allowed, denied   []string
+	}{
+		{
+			name:    "default policy",
+			allowed: []string{"192.0.2.1", "2001:db8::1", "203.0.113.9"},
+		},
+		{
+			name:    "allow list",
+			allow:   "192.0.2.0/24, 2001:db8::/32",
+			allowed: []string{"192.0.2.1", "192.0.2.254", "2001:db8::1"},
+			denied:  []string{"198.51.100.1", "2001:db9::1", "not an ip"},
+		},
+		{
+			name:    "deny list",
+			deny:    "198.51.100.7,2001:db8::bad",
+			allowed: []string{"198.51.100.8", "2001:db8::1"},
+			denied:  []string{"198.51.100.7", "2001:db8::bad", "not an ip"},
+		},
+		{
+			name:    "deny takes precedence",
+			allow:   "192.0.2.0/24",
+			deny:    "192.0.2.128/25",
+			allowed: []string{"192.0.2.1"},
+			denied:  []string{"192.0.2.200", "198.51.100.1"},
+		},
+	} {
+		useAllowNets(t, mustParseCIDRList(t, tc.allow))
+		setForTest(t, &denyNets, mustParseCIDRList(t, tc.deny))
+		for _, ip := range tc.allowed {
+			if !clientAllowed(ip) {
+				t.Errorf("%s: %s refused, want it allowed", tc.name, ip)
+			}
+		}
+		for _, ip := range tc.denied {
+			if clientAllowed(ip) {
+				t.Errorf("%s: %s allowed, want it refused", tc.name, ip)
+			}
+		}
+	}
+}
+
+func TestParseCIDRListRejectsMalformedInput(t *testing.T) {
+	for _, list := range []string{"192.0.2.0/33", "192.0.2", "example.com", "192.0.2.0/24,,nope"} {
+		if _, err := parseCIDRList(list); err == nil {
+			t.Errorf("parsed %q, want an error", list)
+		}
+	}
+}
+
+func TestDeniedClientsAreRefused(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &denyNets, mustParseCIDRList(t, "192.0.2.1"))
+
+	if m := exchange(t, newQuery("hello", dns.TypeTXT)); m.Rcode != dns.RcodeRefused {
+		t.Errorf("denied client got %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for a denied client", got)
+	}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}
+	if m := exchangeFrom(other, newQuery("hello", dns.TypeTXT)); m == nil || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("other client got %v, want NOERROR", m)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"unicode/utf8"
+)
+
+// askEnabled serves GET /ask on the metrics server, set in main
+var askEnabled bool
+
+// askResponse is the JSON body returned by /ask
+type askResponse struct {
+	Answer string `json:"answer,omitempty"`
+	// Candidates holds every answer when -candidates is above 1, Answer being the first
+	Candidates []string `json:"candidates,omitempty"`
+	Cached     bool     `json:"cached"`
+	// Pending is set with -async while the answer is generated, ask again for it
+	Pending bool   `json:"pending,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleAsk answers GET /ask?q=... with the same cache, deduplication, and generation as DNS queries
+func handleAsk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAskResponse(w, http.StatusMethodNotAllowed, askResponse{Error: "method not allowed"})
+		return
+	}
+
+	prompt := normalizePrompt(r.URL.Query().Get("q"))
+	switch {
+	case prompt == "":
+		writeAskResponse(w, http.StatusBadRequest, askResponse{Error: "missing q parameter"})
+		return
+	case maxPromptLen > 0 && utf8.RuneCountInString(prompt) > maxPromptLen:
+		writeAskResponse(w, http.StatusBadRequest, askResponse{Error: "prompt too long"})
+		return
+	case promptBlocklist.Load().blocked(prompt):
+		writeAskResponse(w, http.StatusForbidden, askResponse{Error: "prompt blocked"})
+		return
+	}
+
+	result, err := getOrCreateLLMRequest(r.Context(), prompt, asyncAnswers)
+	if err != nil {
+		logger.Error("Failed to generate response for HTTP request", "question", redactPrompt(prompt), "error", err)
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errBudgetExhausted):
+			status = http.StatusTooManyRequests
+		case errors.Is(err, ErrUpstreamUnavailable):
+			status = http.StatusServiceUnavailable
+		}
+		_, text := extendedErrorFor(err)
+		writeAskResponse(w, status, askResponse{Error: text})
+		return
+	}
+	if result.pending {
+		writeAskResponse(w, http.StatusAccepted, askResponse{Pending: true})
+		return
+	}
+	resp := askResponse{Cached: result.cached}
+	resp.Answer = result.answers[0]
+	if len(result.answers) > 1 {
+		resp.Candidates = result.answers
+	}
+	writeAskResponse(w, http.StatusOK, resp)
+}
+
+func writeAskResponse(w http.ResponseWriter, status int, body askResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// ask calls handleAsk for q through an httptest server, returning the status and decoded body
+func ask(t *testing.T, srv *httptest.Server, q string) (int, askResponse) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/ask?q=" + url.QueryEscape(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body askResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestAskUsesCache(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("Go is a programming language."))
+	srv := httptest.NewServer(http.HandlerFunc(handleAsk))
+	t.Cleanup(srv.Close)
+
+	status, body := ask(t, srv, "What is  Go")
+	if status != http.StatusOK || body.Answer != "Go is a programming language." || body.Cached {
+		t.Fatalf("first call got %d %+v, want a fresh answer", status, body)
+	}
+	status, body = ask(t, srv, "what is go")
+	if status != http.StatusOK || body.Answer != "Go is a programming language." || !body.Cached {
+		t.Errorf("second call got %d %+v, want the cached answer", status, body)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want 1", got)
+	}
+
+	// It shares the cache with DNS queries for the same question
+	if got := txtStrings(exchange(t, newQuery("what.is.go", dns.TypeTXT))); !slices.Equal(got, []string{"Go is a programming language."}) || calls.Load() != 1 {
+		t.Errorf("DNS query got %q after %d generations, want the cached answer", got, calls.Load())
+	}
+}
+
+func TestAskRejectsBadRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleAsk))
+	t.Cleanup(srv.Close)
+
+	if status, body := ask(t, srv, "   "); status != http.StatusBadRequest || body.Error != "missing q parameter" {
+		t.Errorf("empty question got %d %+v", status, body)
+	}
+	resp, err := http.Post(srv.URL+"/ask?q=hello", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodGet {
+		t.Errorf("POST got %d with Allow %q, want 405 allowing GET", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestAskHangUpDoesNotFailCoalescedQueries(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &negativeTTL, time.Minute)
+	release := make(chan struct{})
+	calls := stubGenerate(t, func(ctx context.Context, _ string) ([]string, error) {
+		select {
+		case <-release:
+			return []string{"Shared answer."}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	srv := httptest.NewServer(http.HandlerFunc(handleAsk))
+	t.Cleanup(srv.Close)
+
+	// The HTTP client leads the generation, then hangs up while a DNS query waits on it
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/ask?q=shared+question", nil)
+	asked := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		asked <- err
+	}()
+	waitFor(t, "the HTTP request to start generating", func() bool { return calls.Load() == 1 })
+	deduped := testutil.ToFloat64(inFlightDedupTotal)
+	answered := make(chan *dns.Msg, 1)
+	go func() { answered <- exchangeFrom(testClientAddr, newQuery("shared.question", dns.TypeTXT)) }()
+	waitFor(t, "the DNS query to wait on the generation", func() bool {
+		return testutil.ToFloat64(inFlightDedupTotal) > deduped
+	})
+	cancel()
+	if err := <-asked; err == nil {
+		t.Error("HTTP request succeeded after hanging up")
+	}
+	// Give the server time to notice the hang-up and cancel the request's context
+	time.Sleep(100 * time.Millisecond)
+
+	close(release)
+	if got := txtStrings(<-answered); !slices.Equal(got, []string{"Shared answer."}) {
+		t.Errorf("coalesced DNS query got %q, want the answer", got)
+	}
+	if got := txtStrings(exchange(t, newQuery("shared.question", dns.TypeTXT))); !slices.Equal(got, []string{"Shared answer."}) || calls.Load() != 1 {
+		t.Errorf("next query got %q after %d generations, want the cached answer", got, calls.Load())
+	}
+}
+
+func TestCanceledGenerationIsNotNegativelyCached(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &negativeTTL, time.Minute)
+	stubGenerate(t, func(ctx context.Context, _ string) ([]string, error) {
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	key := cacheKey("given up on")
+	if _, err := generateAndCache(ctx, key, "given up on"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if entry, state := getCacheEntry(key); state != cacheAbsent {
+		t.Errorf("canceled generation cached as %+v", entry)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// blocklistRegexPrefix marks a blocklist line as a regular expression rather than a substring
+const blocklistRegexPrefix = "re:"
+
+// blocklist holds patterns that prompts are refused for, set in main
+type blocklist struct {
+	substrings []string
+	regexps    []*regexp.Regexp
+}
+
+// promptBlocklist is checked before generating, swapped whole when the file is reloaded, nil when unset
+var promptBlocklist atomic.Pointer[blocklist]
+
+// loadBlocklistFile reads one pattern per line, skipping blank lines and # comments. Lines starting with re:
+// are regular expressions, others are substrings. Both match case-insensitively.
+func loadBlocklistFile(path string) (*blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &blocklist{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if expr, ok := strings.CutPrefix(pattern, blocklistRegexPrefix); ok {
+			re, err := regexp.Compile("(?i)" + expr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			b.regexps = append(b.regexps, re)
+			continue
+		}
+		b.substrings = append(b.substrings, strings.ToLower(pattern))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// blocked reports whether prompt matches any pattern, a nil blocklist blocks nothing
+func (b *blocklist) blocked(prompt string) bool {
+	if b == nil {
+		return false
+	}
+	lower := strings.ToLower(prompt)
+	for _, s := range b.substrings {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	for _, re := range b.regexps {
+		if re.MatchString(prompt) {
+			return true
+		}
+	}
+	return false
+}
+
+// len is how many patterns the blocklist has
+func (b *blocklist) len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.substrings) + len(b.regexps)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeBlocklist writes content to a blocklist file in the test's temporary directory, returning its path
+func writeBlocklist(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useBlocklist loads the blocklist at path for the test
+func useBlocklist(t *testing.T, path string) {
+	t.Helper()
+	b, err := loadBlocklistFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := promptBlocklist.Load()
+	promptBlocklist.Store(b)
+	t.Cleanup(func() { promptBlocklist.Store(old) })
+}
+
+func TestBlocklist(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	useBlocklist(t, writeBlocklist(t, "# Moderation\nmalware\n\nre:^how (do|to) (i )?hack\\b\n"))
+
+	for _, name := range []string{"write.some.MALWARE", "how.to.hack.a.bank", "how.do.i.hack.it"} {
+		if m := exchange(t, newQuery(name, dns.TypeTXT)); m.Rcode != dns.RcodeRefused {
+			t.Errorf("%s got %s, want REFUSED", name, dns.RcodeToString[m.Rcode])
+		}
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for blocked prompts", got)
+	}
+
+	for _, name := range []string{"what.is.go", "who.are.hackers", "learn.how.to.hackysack"} {
+		if m := exchange(t, newQuery(name, dns.TypeTXT)); m.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s got %s, want NOERROR", name, dns.RcodeToString[m.Rcode])
+		}
+	}
+}
+
+func TestBlocklistRejectsInvalidRegexp(t *testing.T) {
+	if _, err := loadBlocklistFile(writeBlocklist(t, "fine\nre:(unclosed\n")); err == nil {
+		t.Error("loaded an invalid regular expression")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// errCircuitOpen is returned instead of calling the LLM while the circuit breaker is open
+var errCircuitOpen = fmt.Errorf("%w, circuit breaker open", ErrUpstreamUnavailable)
+
+// breakerState is the state of a circuitBreaker, with values matching the state metric
+type breakerState int
+
+const (
+	// breakerClosed lets every call through, counting consecutive failures
+	breakerClosed breakerState = iota
+	// breakerOpen rejects every call until the cooldown is over
+	breakerOpen
+	// breakerHalfOpen lets a single trial call through, whose outcome closes or reopens the breaker
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops calling a persistently failing upstream for a while, so queries fail fast instead of
+// each waiting out its own timeouts and retries
+type circuitBreaker struct {
+	mu sync.Mutex
+	// threshold is how many consecutive failures open the breaker, 0 disables it
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	// trialRunning is set while the half-open trial call is in flight
+	trialRunning bool
+}
+
+// llmBreaker guards every LLM generation, its threshold and cooldown are set in main
+var llmBreaker = &circuitBreaker{cooldown: defaultBreakerCooldown}
+
+// allow reports whether a call may go ahead. Once the cooldown is over the first caller becomes the half-open
+// trial, and the rest are rejected until it has finished.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.trialRunning = true
+		return true
+	case breakerHalfOpen:
+		if b.trialRunning {
+			return false
+		}
+		b.trialRunning = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a call allow let through
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialRunning = false
+	// A caller giving up, or never getting a concurrency slot to make the call, says nothing about the upstream
+	if errors.Is(err, context.Canceled) || errors.Is(err, errNoLLMSlot) {
+		return
+	}
+	if err == nil {
+		if b.state != breakerClosed {
+			logger.Info("LLM circuit breaker closed, upstream recovered")
+		}
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state == breakerClosed {
+			logger.Warn("LLM circuit breaker opened", "consecutive_failures", b.failures, "cooldown", b.cooldown)
+		} else {
+			logger.Warn("LLM circuit breaker reopened, trial call failed", "cooldown", b.cooldown)
+		}
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState changes the state and its metric, b.mu must be held
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	breakerStateGauge.Set(float64(s))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := &circuitBreaker{threshold: 3, cooldown: 50 * time.Millisecond}
+	failure := &statusError{StatusCode: http.StatusServiceUnavailable}
+	expect := func(what string, state breakerState) {
+		t.Helper()
+		if b.state != state {
+			t.Fatalf("%s: breaker %s, want %s", what, b.state, state)
+		}
+		if got := testutil.ToFloat64(breakerStateGauge); got != float64(state) {
+			t.Errorf("%s: state metric %v, want %d", what, got, state)
+		}
+	}
+
+	// Failures below the threshold, or broken up by a success, don't trip it
+	for _, err := range []error{failure, failure, nil, failure, failure} {
+		if !b.allow() {
+			t.Fatal("closed breaker rejected a call")
+		}
+		b.record(err)
+	}
+	if b.state != breakerClosed {
+		t.Fatalf("breaker %s after non-consecutive failures", b.state)
+	}
+	// Giving up on a call says nothing about the upstream
+	b.allow()
+	b.record(context.Canceled)
+	if b.state != breakerClosed {
+		t.Fatalf("breaker %s after a canceled call", b.state)
+	}
+
+	b.allow()
+	b.record(failure)
+	expect("third consecutive failure", breakerOpen)
+	if b.allow() {
+		t.Error("open breaker let a call through during the cooldown")
+	}
+
+	// After the cooldown a single trial goes ahead, and failing it reopens the breaker
+	time.Sleep(b.cooldown)
+	if !b.allow() {
+		t.Fatal("breaker rejected the trial call after the cooldown")
+	}
+	expect("trial call", breakerHalfOpen)
+	if b.allow() {
+		t.Error("half-open breaker let a second call through alongside the trial")
+	}
+	b.record(failure)
+	expect("failed trial", breakerOpen)
+	if b.allow() {
+		t.Error("reopened breaker let a call through straight away")
+	}
+
+	// A successful trial closes it, resetting the count
+	time.Sleep(b.cooldown)
+	b.allow()
+	b.record(nil)
+	expect("successful trial", breakerClosed)
+	b.allow()
+	b.record(failure)
+	if b.state != breakerClosed {
+		t.Errorf("breaker %s after one failure following recovery", b.state)
+	}
+}
+
+func TestCircuitBreakerStopsLLMCalls(t *testing.T) {
+	setForTest(t, &fallbackAnswer, "")
+	setForTest(t, &llmRetries, 0)
+	setForTest(t, &negativeTTL, 0)
+	var healthy bool
+	p := &fakeProvider{generate: func(context.Context, string) (string, error) {
+		if healthy {
+			return "Back up.", nil
+		}
+		return "", &statusError{StatusCode: http.StatusServiceUnavailable}
+	}}
+	useProvider(t, p)
+	llmBreaker.threshold, llmBreaker.cooldown = 2, 50*time.Millisecond
+	useFreshCache(t)
+
+	for range 2 {
+		exchange(t, newQuery("failing.question", dns.TypeTXT))
+	}
+	// Open now, so queries fail fast without reaching the provider
+	r := newQuery("failing.question", dns.TypeTXT)
+	r.SetEdns0(1232, false)
+	m := exchange(t, r)
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %s with the breaker open, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if ede := extendedError(m); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNotReady {
+		t.Errorf("got extended error %v, want Not Ready", ede)
+	}
+	if _, err := getLLMResponse(context.Background(), "failing question"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("got %v with the breaker open, want errCircuitOpen", err)
+	}
+	if got := p.calls.Load(); got != 2 {
+		t.Errorf("called the provider %d times, want only the 2 that tripped the breaker", got)
+	}
+
+	// Once the upstream is back, the trial after the cooldown succeeds and closes the breaker
+	healthy = true
+	time.Sleep(llmBreaker.cooldown)
+	if got := txtStrings(exchange(t, newQuery("failing.question", dns.TypeTXT))); len(got) != 1 || got[0] != "Back up." {
+		t.Errorf("answered %q after recovery", got)
+	}
+	if llmBreaker.state != breakerClosed {
+		t.Errorf("breaker %s after a successful trial", llmBreaker.state)
+	}
+}
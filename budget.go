@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errBudgetExhausted is returned instead of calling the LLM once today's token budget is used up
+var errBudgetExhausted = errors.New("daily token budget exhausted")
+
+// tokenBudget counts tokens used since midnight UTC against a daily limit
+type tokenBudget struct {
+	mu sync.Mutex
+	// limit is the most tokens to use per day, 0 means unlimited
+	limit int64
+	day   time.Time
+	used  int64
+}
+
+// dailyBudget tracks token usage reported by every provider call, its limit is set in main
+var dailyBudget = &tokenBudget{}
+
+// today is the start of the current UTC day, when the budget resets
+func today() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// resetIfNewDay starts a new day's count after midnight UTC, b.mu must be held
+func (b *tokenBudget) resetIfNewDay() {
+	if day := today(); !day.Equal(b.day) {
+		b.day, b.used = day, 0
+		tokensUsedToday.Set(0)
+	}
+}
+
+// exhausted reports whether today's usage has reached the limit. Generations already running when it's
+// reached can take usage slightly over, which is why this is checked before each call rather than enforced.
+func (b *tokenBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetIfNewDay()
+	return b.limit > 0 && b.used >= b.limit
+}
+
+// add records tokens used by a provider call
+func (b *tokenBudget) add(tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetIfNewDay()
+	b.used += tokens
+	tokensUsedToday.Set(float64(b.used))
+}
+
+// logTokenUsage logs the tokens every LLM call uses at info level instead of debug, for cost analysis
+var logTokenUsage bool
+
+// recordTokenUsage is called by providers with the input and output tokens an API response reports using,
+// counting them against the budget and in metrics and logging them with the ID of the query they're for
+func recordTokenUsage(ctx context.Context, model string, input, output int64) {
+	dailyBudget.add(input + output)
+	if input > 0 {
+		llmTokensTotal.WithLabelValues("input").Add(float64(input))
+	}
+	if output > 0 {
+		llmTokensTotal.WithLabelValues("output").Add(float64(output))
+	}
+
+	level := slog.LevelDebug
+	if logTokenUsage {
+		level = slog.LevelInfo
+	}
+	// Refreshes and other background generations aren't for a particular query, so have no request ID
+	attrs := []any{"input_tokens", input, "output_tokens", output, "model", model}
+	if id := requestIDFrom(ctx); id != "" {
+		attrs = append(attrs, "request_id", id)
+	}
+	logger.Log(ctx, level, "LLM token usage", attrs...)
+}
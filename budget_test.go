@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDailyBudgetExhaustion(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &fallbackAnswer, "")
+	setForTest(t, &dailyBudget, &tokenBudget{limit: 30})
+	var requests atomic.Int64
+	_, p := newOpenAIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// Each reply reports 12 input and 7 output tokens
+		replyWith(openAIReply("An answer."))(w, r)
+	})
+	useProvider(t, p)
+
+	// 19 tokens used, then 38, going over the limit of 30
+	for _, q := range []string{"first.question", "second.question"} {
+		if m := exchange(t, newQuery(q, dns.TypeTXT)); m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s got %s within the budget", q, dns.RcodeToString[m.Rcode])
+		}
+	}
+	if got := testutil.ToFloat64(tokensUsedToday); got != 38 {
+		t.Errorf("tokens used today metric is %v, want 38", got)
+	}
+
+	r := newQuery("third.question", dns.TypeTXT)
+	r.SetEdns0(1232, false)
+	m := exchange(t, r)
+	if m.Rcode != dns.RcodeRefused {
+		t.Errorf("got %s once the budget was exhausted, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+	if ede := extendedError(m); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeProhibited {
+		t.Errorf("got extended error %v, want Prohibited", ede)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("called the LLM %d times, want none once the budget was exhausted", got)
+	}
+
+	// Cached answers are still served, and with a fallback it's answered instead of refusing
+	if m := exchange(t, newQuery("first.question", dns.TypeTXT)); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("cached answer got %s over the budget", dns.RcodeToString[m.Rcode])
+	}
+	setForTest(t, &fallbackAnswer, "Try again tomorrow.")
+	if got := txtStrings(exchange(t, newQuery("fourth.question", dns.TypeTXT))); len(got) != 1 || got[0] != "Try again tomorrow." {
+		t.Errorf("answered %q over the budget, want the fallback", got)
+	}
+}
+
+func TestDailyBudgetResetsAtMidnightUTC(t *testing.T) {
+	b := &tokenBudget{limit: 10}
+	b.add(10)
+	if !b.exhausted() {
+		t.Fatal("not exhausted at the limit")
+	}
+	// Yesterday's usage doesn't count against today's budget
+	b.day = b.day.Add(-24 * time.Hour)
+	if b.exhausted() {
+		t.Error("still exhausted on a new day")
+	}
+	if b.used != 0 {
+		t.Errorf("%d tokens used at the start of a new day", b.used)
+	}
+
+	unlimited := &tokenBudget{}
+	unlimited.add(1 << 40)
+	if unlimited.exhausted() {
+		t.Error("exhausted without a limit")
+	}
+}
+
+func TestTokenUsageFromMockResponse(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &dailyBudget, &tokenBudget{})
+	setForTest(t, &logTokenUsage, true)
+	logs := captureLogs(t, slog.LevelInfo)
+	// The mock reply's usage block reports 12 input and 7 output tokens
+	_, p := newOpenAIServer(t, replyWith(openAIReply("An answer.")))
+	useProvider(t, p)
+
+	input := testutil.ToFloat64(llmTokensTotal.WithLabelValues("input"))
+	output := testutil.ToFloat64(llmTokensTotal.WithLabelValues("output"))
+	m := exchange(t, newQuery("costly.question", dns.TypeTXT))
+	if m.Rcode != dns.RcodeSuccess {
+		t.Fatalf("got %s", dns.RcodeToString[m.Rcode])
+	}
+
+	if got := testutil.ToFloat64(llmTokensTotal.WithLabelValues("input")) - input; got != 12 {
+		t.Errorf("counted %v input tokens, want 12", got)
+	}
+	if got := testutil.ToFloat64(llmTokensTotal.WithLabelValues("output")) - output; got != 7 {
+		t.Errorf("counted %v output tokens, want 7", got)
+	}
+	if got := dailyBudget.used; got != 19 {
+		t.Errorf("%d tokens counted against the budget, want 19", got)
+	}
+
+	// Logged with the ID of the query it was for, so spend can be tied back to it
+	out := logs.String()
+	var line string
+	for l := range strings.Lines(out) {
+		if strings.Contains(l, "LLM token usage") {
+			line = l
+		}
+	}
+	for _, want := range []string{"input_tokens=12", "output_tokens=7", "model=" + defaultOpenAIModel, "request_id="} {
+		if !strings.Contains(line, want) {
+			t.Errorf("usage log line %q is missing %s", line, want)
+		}
+	}
+}
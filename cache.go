@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Backends selectable with -cache-backend
+const (
+	cacheBackendMemory = "memory"
+	cacheBackendRedis  = "redis"
+)
+
+const (
+	defaultCacheTTL           = 1 * time.Hour
+	defaultCacheMaxEntries    = 10000
+	defaultCachePurgeInterval = 5 * time.Minute
+	defaultNegativeCacheTTL   = 30 * time.Second
+	defaultMaxStale           = 24 * time.Hour
+	// staleAnswerTTL is the TTL on stale answers, the 30 seconds RFC 8767 recommends
+	staleAnswerTTL = 30 * time.Second
+)
+
+type cacheEntry struct {
+	key       string
+	response  string
+	expiresAt time.Time
+	// createdAt is when the response was generated, zero for negative entries and ones cached before it was kept
+	createdAt time.Time
+	// failed marks a negative entry, recording that generation failed rather than holding a response
+	failed bool
+	// compressed holds the gzipped response inside a memoryCache with compress set, response is then empty
+	compressed []byte
+}
+
+// Cache stores generated responses by cacheKey. Freshness is decided by the caller from expiresAt, so a
+// backend only has to keep an entry for as long as Set asks and may drop it sooner, e.g. to bound memory.
+type Cache interface {
+	// Get returns the entry for key, whether or not it has expired
+	Get(key string) (cacheEntry, bool)
+	// Set stores entry under entry.key, keeping it for at least ttl if possible
+	Set(entry cacheEntry, ttl time.Duration)
+}
+
+// cacheLocker is implemented by shared backends that can elect a single replica to generate each response
+type cacheLocker interface {
+	// TryLock takes the lock for key for at most ttl, reporting whether it was acquired
+	TryLock(key string, ttl time.Duration) (token string, ok bool)
+	// Unlock releases a lock taken by TryLock
+	Unlock(key, token string)
+}
+
+var (
+	// responseCache holds every generated response, in memory unless -cache-backend says otherwise
+	responseCache Cache = newMemoryCache(defaultCacheMaxEntries)
+
+	cacheTTL    = defaultCacheTTL
+	negativeTTL = defaultNegativeCacheTTL
+	// serveStale answers with expired entries up to maxStale old while they're refreshed in the background
+	serveStale bool
+	maxStale   = defaultMaxStale
+	// cacheJitter is the percentage cache TTLs are randomly adjusted by, 0 disables jitter
+	cacheJitter int
+)
+
+// cacheKeyBytes is how much of the SHA-256 digest cacheKey keeps. At 128 bits, even billions of distinct
+// queries have a collision chance far below that of a hardware fault, while keys stay 32 bytes however long the query.
+const cacheKeyBytes = 16
+
+// cacheKey identifies q under the current model and system prompt, so changing either, even with a
+// persisted cache, doesn't serve answers generated under the old configuration. Unsanitized answers kept
+// for base64 encoding are keyed apart too, so they're never served raw, as are answers from -candidates above 1,
+// so changing it doesn't serve the old number of candidates. It's hashed so memory per entry
+// is bounded and persisted caches don't hold prompts, callers keep q itself for logging.
+func cacheKey(q string) string {
+	model := ""
+	if provider != nil {
+		model = provider.Model()
+	}
+	if answerEncoding == answerEncodingBase64 {
+		model += "|unsanitized"
+	}
+	if llmCandidates > 1 {
+		model += "|candidates=" + strconv.Itoa(llmCandidates)
+	}
+	promptSum := sha256.Sum256([]byte(currentSystemPrompt()))
+	sum := sha256.Sum256([]byte(model + "|" + hex.EncodeToString(promptSum[:8]) + "|" + q))
+	return hex.EncodeToString(sum[:cacheKeyBytes])
+}
+
+// cacheState is whether a cache lookup found a fresh entry, an expired one that can still be served, or nothing
+type cacheState int
+
+const (
+	cacheAbsent cacheState = iota
+	cacheFresh
+	cacheStale
+)
+
+func getCache(q string) (string, bool) {
+	entry, state := getCacheEntry(q)
+	if state != cacheFresh || entry.failed {
+		return "", false
+	}
+	return entry.response, true
+}
+
+// getCacheEntry returns the cache entry for q, which may be a negative entry, and whether it's fresh.
+// With serveStale, successful entries expired less than maxStale ago are returned as stale.
+func getCacheEntry(q string) (cacheEntry, cacheState) {
+	res, ok := responseCache.Get(q)
+	if !ok {
+		cacheMissesTotal.Inc()
+		return cacheEntry{}, cacheAbsent
+	}
+	now := time.Now()
+	if now.Before(res.expiresAt) {
+		cacheHitsTotal.Inc()
+		return res, cacheFresh
+	}
+	if !res.failed && now.Before(res.expiresAt.Add(staleWindow())) {
+		cacheStaleHitsTotal.Inc()
+		return res, cacheStale
+	}
+	cacheMissesTotal.Inc()
+	return cacheEntry{}, cacheAbsent
+}
+
+// staleWindow is how long after expiry an entry can still be served, 0 unless serveStale is set
+func staleWindow() time.Duration {
+	if !serveStale {
+		return 0
+	}
+	return maxStale
+}
+
+// setCache stores the candidate answers generated at createdAt for ttl, adjusted by cacheJitter, and returns when
+// it expires. A ttl of 0 or less disables caching.
+func setCache(q string, answers []string, createdAt time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	ttl = jitterTTL(ttl)
+	expiresAt := time.Now().Add(ttl)
+	// Kept past expiry for as long as it can be served stale
+	responseCache.Set(cacheEntry{key: q, response: joinCandidates(answers), expiresAt: expiresAt, createdAt: createdAt}, ttl+staleWindow())
+	return expiresAt
+}
+
+// jitterTTL spreads ttl randomly by up to cacheJitter percent either way, so entries cached together,
+// like preloaded ones, don't all expire and regenerate at once
+func jitterTTL(ttl time.Duration) time.Duration {
+	if cacheJitter <= 0 {
+		return ttl
+	}
+	spread := int64(ttl) * int64(cacheJitter) / 100
+	if spread <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int64N(2*spread+1)-spread)
+}
+
+// setNegativeCache records that generating a response for q failed, so repeats fail fast for ttl
+func setNegativeCache(q string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	responseCache.Set(cacheEntry{key: q, expiresAt: time.Now().Add(ttl), failed: true}, ttl)
+}
+
+// memoryCache is the in-process Cache, evicting the least recently used entries beyond maxEntries
+type memoryCache struct {
+	mu sync.Mutex
+	// entries maps a key to its element in order, which is kept in most-recently-used order
+	entries    map[string]*list.Element
+	order      *list.List
+	maxEntries int
+	// compress gzips stored responses where that makes them smaller, decompressing them in Get
+	compress bool
+	// savedBytes is how much smaller compression has made the held responses
+	savedBytes int
+}
+
+// newMemoryCache creates an empty memoryCache holding up to maxEntries entries, 0 means unlimited
+func newMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+func (c *memoryCache) Get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return cacheEntry{}, false
+	}
+	// A lookup counts as a use even if the entry turns out to be expired, as it may be served stale
+	c.order.MoveToFront(el)
+	entry := *el.Value.(*cacheEntry)
+	c.mu.Unlock()
+
+	// Decompress outside the lock, so lookups for other keys aren't held up
+	if err := entry.decompress(); err != nil {
+		logger.Warn("Failed to decompress cache entry", "error", err)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// Set stores entry as the most recently used, it's kept until purged after ttl or evicted
+func (c *memoryCache) Set(entry cacheEntry, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(&entry)
+}
+
+// Len returns how many entries are held, including expired ones not yet purged
+func (c *memoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// store adds or replaces an entry as the most recently used, c.mu must be held
+func (c *memoryCache) store(entry *cacheEntry) {
+	if c.compress {
+		entry.compressResponse()
+		c.addSaved(entry.savedBytes())
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		c.addSaved(-el.Value.(*cacheEntry).savedBytes())
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache is within maxEntries, c.mu must be held
+func (c *memoryCache) evict() {
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove deletes an entry from the cache, c.mu must be held
+func (c *memoryCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	entry := el.Value.(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.addSaved(-entry.savedBytes())
+}
+
+// addSaved adjusts savedBytes and its metric by n, c.mu must be held
+func (c *memoryCache) addSaved(n int) {
+	if n == 0 {
+		return
+	}
+	c.savedBytes += n
+	cacheCompressionSavedBytes.Set(float64(c.savedBytes))
+}
+
+// compressResponse replaces the response with its gzipped form if that's smaller. Short answers usually aren't
+// worth it, as gzip adds around 20 bytes of framing, so they're left as they are.
+func (e *cacheEntry) compressResponse() {
+	if e.response == "" {
+		return
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(e.response)); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(e.response) {
+		return
+	}
+	// Copied so the buffer's spare capacity isn't kept around
+	e.compressed, e.response = bytes.Clone(buf.Bytes()), ""
+}
+
+// decompress restores a response replaced by compressResponse, doing nothing if it wasn't compressed
+func (e *cacheEntry) decompress() error {
+	if e.compressed == nil {
+		return nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(e.compressed))
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	e.response, e.compressed = string(data), nil
+	return nil
+}
+
+// savedBytes is how much smaller compressing made the entry's response, read from the uncompressed size gzip
+// records in its last 4 bytes
+func (e *cacheEntry) savedBytes() int {
+	if len(e.compressed) < 4 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(e.compressed[len(e.compressed)-4:])) - len(e.compressed)
+}
+
+// purgeExpired removes all expired entries, other than those that can be served stale, and returns how many were removed
+func (c *memoryCache) purgeExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	removed := 0
+	for _, el := range c.entries {
+		// Entries that can still be served stale are kept until they can't
+		entry := el.Value.(*cacheEntry)
+		expiry := entry.expiresAt
+		if !entry.failed {
+			expiry = expiry.Add(staleWindow())
+		}
+		if !now.Before(expiry) {
+			c.remove(el)
+			removed++
+		}
+	}
+	return removed
+}
+
+// runCachePurger purges expired entries from c every interval until ctx is cancelled
+func runCachePurger(ctx context.Context, c *memoryCache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := c.purgeExpired(); removed > 0 {
+				logger.Info("Purged expired cache entries", "count", removed)
+			}
+		}
+	}
+}
+
+// persistedCacheEntry is the on-disk form of a cacheEntry
+type persistedCacheEntry struct {
+	Query     string    `json:"query"`
+	Response  string    `json:"response"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// save writes all unexpired entries to path as JSON, least recently used first
+func (c *memoryCache) save(path string) (int, error) {
+	c.mu.Lock()
+	now := time.Now()
+	entries := make([]persistedCacheEntry, 0, c.order.Len())
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		entry := *el.Value.(*cacheEntry)
+		if err := entry.decompress(); err != nil {
+			logger.Warn("Failed to decompress cache entry, not saving it", "error", err)
+			continue
+		}
+		// Negative entries are too short lived to be worth persisting
+		if now.Before(entry.expiresAt) && !entry.failed {
+			entries = append(entries, persistedCacheEntry{
+				Query:     entry.key,
+				Response:  entry.response,
+				ExpiresAt: entry.expiresAt,
+				CreatedAt: entry.createdAt,
+			})
+		}
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file first so a crash mid-write doesn't corrupt the existing cache file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// load populates the cache from a file written by save, skipping expired entries.
+// A missing file is not an error, as there is nothing to load on the first run.
+func (c *memoryCache) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []persistedCacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	loaded := 0
+	for _, e := range entries {
+		if !now.Before(e.ExpiresAt) {
+			continue
+		}
+		c.store(&cacheEntry{key: e.Query, response: e.Response, expiresAt: e.ExpiresAt, createdAt: e.CreatedAt})
+		loaded++
+	}
+	return loaded, nil
+}
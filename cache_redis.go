@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisURL = "redis://localhost:6379/0"
+	// redisKeyPrefix namespaces our keys in a Redis shared with other applications
+	redisKeyPrefix = "dnschat:"
+	// redisLockPrefix namespaces generation locks, separately from cached entries
+	redisLockPrefix = redisKeyPrefix + "lock:"
+	// redisTimeout bounds each Redis call, a slow cache shouldn't hold up answering
+	redisTimeout = 500 * time.Millisecond
+)
+
+// redisCache is a Cache shared by every replica pointed at the same Redis, so each benefits from the others'
+// generations. Errors are logged and treated as misses, so a Redis outage degrades to calling the LLM.
+type redisCache struct {
+	client *redis.Client
+}
+
+// redisCacheValue is the stored form of a cacheEntry
+type redisCacheValue struct {
+	Response  string    `json:"response,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	Failed    bool      `json:"failed,omitempty"`
+}
+
+// newRedisCache connects to the Redis at url, e.g. redis://:password@host:6379/0, checking it's reachable
+func newRedisCache(ctx context.Context, url string) (*redisCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisCache{client: client}, nil
+}
+
+func (c *redisCache) Get(key string) (cacheEntry, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := c.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return cacheEntry{}, false
+	}
+	if err != nil {
+		logger.Warn("Failed to read from Redis cache", "error", err)
+		return cacheEntry{}, false
+	}
+	var v redisCacheValue
+	if err := json.Unmarshal(data, &v); err != nil {
+		logger.Warn("Invalid entry in Redis cache", "error", err)
+		return cacheEntry{}, false
+	}
+	return cacheEntry{key: key, response: v.Response, expiresAt: v.ExpiresAt, createdAt: v.CreatedAt, failed: v.Failed}, true
+}
+
+// Set stores entry with a Redis expiry of ttl, so Redis removes it once it can't be served
+func (c *redisCache) Set(entry cacheEntry, ttl time.Duration) {
+	data, err := json.Marshal(redisCacheValue{Response: entry.response, ExpiresAt: entry.expiresAt, CreatedAt: entry.createdAt, Failed: entry.failed})
+	if err != nil {
+		logger.Warn("Failed to encode Redis cache entry", "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := c.client.Set(ctx, redisKeyPrefix+entry.key, data, ttl).Err(); err != nil {
+		logger.Warn("Failed to write to Redis cache", "error", err)
+	}
+}
+
+// redisUnlockScript deletes a lock only if it still holds our token, so a lock that expired and was taken
+// by another replica isn't released from under it
+var redisUnlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// TryLock takes the generation lock for key with SET NX, expiring after ttl so a replica that dies while
+// holding it can't block the key forever. The returned token must be passed to Unlock.
+func (c *redisCache) TryLock(key string, ttl time.Duration) (string, bool) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	ok, err := c.client.SetNX(ctx, redisLockPrefix+key, token, ttl).Result()
+	if err != nil {
+		// Generating without the lock only risks a duplicate LLM call, better than not answering
+		logger.Warn("Failed to take Redis generation lock", "error", err)
+		return "", true
+	}
+	return token, ok
+}
+
+// Unlock releases a lock taken by TryLock
+func (c *redisCache) Unlock(key, token string) {
+	if token == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := redisUnlockScript.Run(ctx, c.client, []string{redisLockPrefix + key}, token).Err(); err != nil {
+		logger.Warn("Failed to release Redis generation lock", "error", err)
+	}
+}
+
+// Close disconnects from Redis
+func (c *redisCache) Close() error {
+	return c.client.Close()
+}
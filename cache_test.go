@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// setEntry stores a fresh entry for key answering response
+func setEntry(c *memoryCache, key, response string) {
+	c.Set(cacheEntry{key: key, response: response, expiresAt: time.Now().Add(time.Hour)}, time.Hour)
+}
+
+// heldKeys reports which of keys c still holds
+func heldKeys(c *memoryCache, keys ...string) map[string]bool {
+	held := make(map[string]bool)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		_, held[k] = c.entries[k]
+	}
+	return held
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newMemoryCache(3)
+	setEntry(c, "a", "1")
+	setEntry(c, "b", "2")
+	setEntry(c, "c", "3")
+
+	// Reading a and rewriting b leaves c least recently used
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a missing before the cache was full")
+	}
+	setEntry(c, "b", "2 again")
+	setEntry(c, "d", "4")
+	if got, want := heldKeys(c, "a", "b", "c", "d"), map[string]bool{"a": true, "b": true, "c": false, "d": true}; !maps.Equal(got, want) {
+		t.Errorf("after adding d held %v, want %v", got, want)
+	}
+
+	// Now a is the oldest use, then b
+	setEntry(c, "e", "5")
+	setEntry(c, "f", "6")
+	if got, want := heldKeys(c, "a", "b", "d", "e", "f"), map[string]bool{"a": false, "b": false, "d": true, "e": true, "f": true}; !maps.Equal(got, want) {
+		t.Errorf("after adding e and f held %v, want %v", got, want)
+	}
+	if got := c.Len(); got != 3 {
+		t.Errorf("holding %d entries, want the limit of 3", got)
+	}
+	if entry, ok := c.Get("d"); !ok || entry.response != "4" {
+		t.Errorf("got d=%q, %v, want it kept unchanged", entry.response, ok)
+	}
+}
+
+func TestMemoryCacheUnlimited(t *testing.T) {
+	c := newMemoryCache(0)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		setEntry(c, k, k)
+	}
+	if got := c.Len(); got != 5 {
+		t.Errorf("holding %d entries, want all 5 with no limit", got)
+	}
+}
+
+func TestNegativeCacheShortCircuitsLLM(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		return nil, ErrUpstreamUnavailable
+	})
+	setForTest(t, &negativeTTL, time.Minute)
+	setForTest(t, &fallbackAnswer, "")
+
+	for i := range 3 {
+		if m := exchange(t, newQuery("flaky.question", dns.TypeTXT)); m.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("query %d got %s, want SERVFAIL", i, dns.RcodeToString[m.Rcode])
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want repeats answered from the negative entry", got)
+	}
+	if _, err := getOrCreateLLMRequest(context.Background(), "flaky question", false); !errors.Is(err, errNegativeCached) {
+		t.Errorf("got %v, want errNegativeCached", err)
+	}
+
+	// Without negative caching every query tries again
+	useFreshCache(t)
+	setForTest(t, &negativeTTL, 0)
+	exchange(t, newQuery("flaky.question", dns.TypeTXT))
+	exchange(t, newQuery("flaky.question", dns.TypeTXT))
+	if got := calls.Load(); got != 3 {
+		t.Errorf("generated %d times in all, want 2 more with -negative-ttl 0", got)
+	}
+}
+
+func TestCacheKeyIncludesModelAndSystemPrompt(t *testing.T) {
+	c := useFreshCache(t)
+	for _, model := range []string{"alpha", "beta"} {
+		useProvider(t, &fakeProvider{model: model, generate: func(context.Context, string) (string, error) {
+			return "Answer from " + model, nil
+		}})
+		result, err := getOrCreateLLMRequest(context.Background(), "what is go", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Answer from " + model; !slices.Equal(result.answers, []string{want}) {
+			t.Errorf("under %s got %q, want %q rather than another model's answer", model, result.answers, want)
+		}
+	}
+	if got := c.Len(); got != 2 {
+		t.Errorf("cache holds %d entries, want one per model", got)
+	}
+
+	keyA := cacheKey("what is go")
+	old := systemPrompt.Load()
+	t.Cleanup(func() { systemPrompt.Store(old) })
+	prompt := "A different system prompt: " + promptPlaceholder
+	systemPrompt.Store(&prompt)
+	if cacheKey("what is go") == keyA {
+		t.Error("changing the system prompt kept the same cache key")
+	}
+
+	keyB := cacheKey("what is go")
+	setForTest(t, &llmCandidates, 3)
+	if cacheKey("what is go") == keyB {
+		t.Error("changing -candidates kept the same cache key")
+	}
+}
+
+func TestCacheJitterWindow(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &cacheJitter, 10)
+	ttl := time.Hour
+	low, high := ttl-6*time.Minute, ttl+6*time.Minute
+
+	seen := make(map[time.Duration]bool)
+	for range 200 {
+		got := jitterTTL(ttl)
+		if got < low || got > high {
+			t.Fatalf("jittered TTL %s outside %s to %s", got, low, high)
+		}
+		seen[got.Truncate(time.Minute)] = true
+	}
+	if len(seen) < 5 {
+		t.Errorf("200 jittered TTLs fell in only %d distinct minutes, want them spread out", len(seen))
+	}
+
+	// setCache's expiry uses the same window
+	for i := range 20 {
+		before := time.Now()
+		expiresAt := setCache(fmt.Sprint("jittered ", i), []string{"answer"}, before, ttl)
+		if expiresAt.Before(before.Add(low)) || expiresAt.After(time.Now().Add(high)) {
+			t.Errorf("entry expires in %s, want within %s to %s", expiresAt.Sub(before), low, high)
+		}
+	}
+
+	setForTest(t, &cacheJitter, 0)
+	if got := jitterTTL(ttl); got != ttl {
+		t.Errorf("with no jitter got %s, want %s", got, ttl)
+	}
+}
+
+// expireEntry moves the cache entry for q to have expired ago
+func expireEntry(t *testing.T, c *memoryCache, q string, ago time.Duration) {
+	t.Helper()
+	entry, ok := c.Get(cacheKey(q))
+	if !ok {
+		t.Fatalf("%q isn't cached", q)
+	}
+	entry.expiresAt = time.Now().Add(-ago)
+	c.Set(entry, time.Hour)
+}
+
+func TestServeStaleWhileRefreshing(t *testing.T) {
+	c := useFreshCache(t)
+	setForTest(t, &serveStale, true)
+	setForTest(t, &maxStale, time.Hour)
+	var answer atomic.Value
+	answer.Store("Old answer.")
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		return []string{answer.Load().(string)}, nil
+	})
+
+	exchange(t, newQuery("changing.question", dns.TypeTXT))
+	expireEntry(t, c, "changing question", time.Minute)
+	answer.Store("New answer.")
+
+	m := exchange(t, newQuery("changing.question", dns.TypeTXT))
+	if got := txtStrings(m); !slices.Equal(got, []string{"Old answer."}) {
+		t.Errorf("expired entry got %q, want it served stale", got)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != uint32(staleAnswerTTL/time.Second) {
+		t.Errorf("stale answer has TTL %d, want %d", ttl, staleAnswerTTL/time.Second)
+	}
+	waitFor(t, "the background refresh", func() bool {
+		entry, state := getCacheEntry(cacheKey("changing question"))
+		return state == cacheFresh && entry.response == "New answer."
+	})
+	if got := txtStrings(exchange(t, newQuery("changing.question", dns.TypeTXT))); !slices.Equal(got, []string{"New answer."}) {
+		t.Errorf("after the refresh got %q, want the new answer", got)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("generated %d times, want the first answer and one refresh", got)
+	}
+
+	// Past -max-stale the entry is regenerated before answering
+	expireEntry(t, c, "changing question", 2*time.Hour)
+	answer.Store("Newest answer.")
+	if got := txtStrings(exchange(t, newQuery("changing.question", dns.TypeTXT))); !slices.Equal(got, []string{"Newest answer."}) {
+		t.Errorf("entry past max-stale got %q, want a fresh generation", got)
+	}
+}
+
+func TestServeStaleKeepsEntryWhenRefreshFails(t *testing.T) {
+	c := useFreshCache(t)
+	setForTest(t, &serveStale, true)
+	var failing atomic.Bool
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		if failing.Load() {
+			return nil, ErrUpstreamUnavailable
+		}
+		return []string{"Still good."}, nil
+	})
+
+	exchange(t, newQuery("resilient.question", dns.TypeTXT))
+	expireEntry(t, c, "resilient question", time.Minute)
+	failing.Store(true)
+
+	refreshed := func(n int64) func() bool {
+		return func() bool {
+			inFlightMutex.RLock()
+			defer inFlightMutex.RUnlock()
+			return calls.Load() == n && len(inFlightRequests) == 0
+		}
+	}
+	exchange(t, newQuery("resilient.question", dns.TypeTXT))
+	waitFor(t, "the refresh to fail", refreshed(2))
+	if got := txtStrings(exchange(t, newQuery("resilient.question", dns.TypeTXT))); !slices.Equal(got, []string{"Still good."}) {
+		t.Errorf("after a failed refresh got %q, want the stale answer still served", got)
+	}
+	waitFor(t, "the next refresh to fail", refreshed(3))
+}
+
+func TestCacheKeysAreDistinctAndBounded(t *testing.T) {
+	keys := make(map[string]string)
+	queries := []string{"what is go", "what is go?", "what is dns", "What is go", strings.Repeat("long question ", 100)}
+	for i := range 1000 {
+		queries = append(queries, fmt.Sprintf("question %d", i))
+	}
+	for _, q := range queries {
+		key := cacheKey(q)
+		if other, ok := keys[key]; ok {
+			t.Errorf("%q and %q share the key %s", q, other, key)
+		}
+		keys[key] = q
+		if len(key) != 2*cacheKeyBytes {
+			t.Errorf("key for a %d byte query is %d characters, want %d", len(q), len(key), 2*cacheKeyBytes)
+		}
+		if strings.Contains(key, "question") || strings.Contains(key, "what") {
+			t.Errorf("key %s holds the query", key)
+		}
+	}
+	if cacheKey("what is go") != cacheKey("what is go") {
+		t.Error("the same query got different keys")
+	}
+}
+
+// fakeBackend is a Cache standing in for a shared backend like Redis, recording the TTL each entry was set with
+type fakeBackend struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	ttls    map[string]time.Duration
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{entries: make(map[string]cacheEntry), ttls: make(map[string]time.Duration)}
+}
+
+func (b *fakeBackend) Get(key string) (cacheEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.entries[key]
+	return entry, ok
+}
+
+func (b *fakeBackend) Set(entry cacheEntry, ttl time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[entry.key] = entry
+	b.ttls[entry.key] = ttl
+}
+
+func TestCacheBackendIsPluggable(t *testing.T) {
+	backend := newFakeBackend()
+	setForTest(t, &responseCache, Cache(backend))
+	setForTest(t, &cacheJitter, 0)
+	calls := stubGenerate(t, answerWith("A shared answer."))
+
+	for range 2 {
+		if got := txtStrings(exchange(t, newQuery("what.is.go", dns.TypeTXT))); !slices.Equal(got, []string{"A shared answer."}) {
+			t.Fatalf("answered %q", got)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want the repeat answered from the backend", got)
+	}
+
+	key := cacheKey("what is go")
+	entry, ok := backend.Get(key)
+	if !ok || entry.response != "A shared answer." {
+		t.Fatalf("backend holds %+v, %v under the query's key", entry, ok)
+	}
+	if got := backend.ttls[key]; got != cacheTTL+staleWindow() {
+		t.Errorf("entry set with TTL %v, want %v", got, cacheTTL+staleWindow())
+	}
+
+	// An entry another replica wrote is served without generating
+	backend.Set(cacheEntry{key: cacheKey("what is dns"), response: "From another replica.", expiresAt: time.Now().Add(time.Hour)}, time.Hour)
+	if got := txtStrings(exchange(t, newQuery("what.is.dns", dns.TypeTXT))); !slices.Equal(got, []string{"From another replica."}) {
+		t.Errorf("answered %q, want the backend's entry", got)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want the backend's entry used", got)
+	}
+}
+
+// fakeLockingBackend is a fakeBackend that also elects a generator per key, as Redis does with SET NX
+type fakeLockingBackend struct {
+	*fakeBackend
+	locks map[string]fakeLock
+}
+
+type fakeLock struct {
+	token     string
+	expiresAt time.Time
+}
+
+func newFakeLockingBackend() *fakeLockingBackend {
+	return &fakeLockingBackend{fakeBackend: newFakeBackend(), locks: make(map[string]fakeLock)}
+}
+
+func (b *fakeLockingBackend) TryLock(key string, ttl time.Duration) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if l, ok := b.locks[key]; ok && time.Now().Before(l.expiresAt) {
+		return "", false
+	}
+	token := fmt.Sprint(time.Now().UnixNano())
+	b.locks[key] = fakeLock{token: token, expiresAt: time.Now().Add(ttl)}
+	return token, true
+}
+
+func (b *fakeLockingBackend) Unlock(key, token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.locks[key].token == token {
+		delete(b.locks, key)
+	}
+}
+
+func TestDistributedLockSharesOneGeneration(t *testing.T) {
+	backend := newFakeLockingBackend()
+	setForTest(t, &responseCache, Cache(backend))
+	setForTest(t, &distributedLock, true)
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		time.Sleep(200 * time.Millisecond)
+		return []string{"Generated once."}, nil
+	})
+
+	// generateShared is where replicas meet, each instance's in-flight dedup being local to it
+	key := cacheKey("what is go")
+	results := make([]llmResult, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if results[i], err = generateShared(context.Background(), key, "what is go"); err != nil {
+				t.Errorf("instance %d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times across both instances, want 1", got)
+	}
+	for i, r := range results {
+		if !slices.Equal(r.answers, []string{"Generated once."}) {
+			t.Errorf("instance %d answered %q", i, r.answers)
+		}
+	}
+	if results[0].cached == results[1].cached {
+		t.Errorf("cached=%v and %v, want exactly one instance reading the other's result", results[0].cached, results[1].cached)
+	}
+	if _, held := backend.locks[key]; held {
+		t.Error("lock still held after generating")
+	}
+}
+
+func TestDistributedLockExpiresWithItsHolder(t *testing.T) {
+	backend := newFakeLockingBackend()
+	setForTest(t, &responseCache, Cache(backend))
+	setForTest(t, &distributedLock, true)
+	calls := stubGenerate(t, answerWith("Taken over."))
+
+	// A replica that died mid-generation leaves its lock behind, never caching a result
+	key := cacheKey("what is go")
+	if _, ok := backend.TryLock(key, 300*time.Millisecond); !ok {
+		t.Fatal("couldn't take the lock")
+	}
+
+	start := time.Now()
+	result, err := generateShared(context.Background(), key, "what is go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.answers, []string{"Taken over."}) || calls.Load() != 1 {
+		t.Errorf("answered %q after %d generations, want this instance to generate", result.answers, calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("generated after %v, before the dead holder's lock expired", elapsed)
+	}
+}
+
+func TestMemoryCacheCompressionRoundTrip(t *testing.T) {
+	c := newMemoryCache(0)
+	c.compress = true
+	long := strings.Repeat("A long and repetitive answer compresses well. ", 40)
+	setEntry(c, "long", long)
+	setEntry(c, "short", "Yes.")
+
+	c.mu.Lock()
+	stored := *c.entries["long"].Value.(*cacheEntry)
+	short := *c.entries["short"].Value.(*cacheEntry)
+	saved := c.savedBytes
+	c.mu.Unlock()
+	if stored.compressed == nil || stored.response != "" || len(stored.compressed) >= len(long) {
+		t.Errorf("long response stored as %d raw and %d compressed bytes, want it compressed", len(stored.response), len(stored.compressed))
+	}
+	// gzip's framing would make a short answer bigger
+	if short.compressed != nil || short.response != "Yes." {
+		t.Errorf("short response stored as %q and %d compressed bytes, want it raw", short.response, len(short.compressed))
+	}
+	if want := len(long) - len(stored.compressed); saved != want {
+		t.Errorf("saved %d bytes, want %d", saved, want)
+	}
+
+	for key, want := range map[string]string{"long": long, "short": "Yes."} {
+		if entry, ok := c.Get(key); !ok || entry.response != want || entry.compressed != nil {
+			t.Errorf("%s read back as %d bytes, %v, want the original %d", key, len(entry.response), ok, len(want))
+		}
+	}
+
+	// Persisting writes the decompressed response
+	path := t.TempDir() + "/cache.json"
+	if _, err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newMemoryCache(0)
+	if _, err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := loaded.Get("long"); !ok || entry.response != long {
+		t.Errorf("long response loaded as %d bytes, %v", len(entry.response), ok)
+	}
+}
+
+func TestTimestampIsStableAcrossCachedReads(t *testing.T) {
+	c := useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &includeTimestamp, timestampUnix)
+
+	timestamp := func(name string) string {
+		t.Helper()
+		strs := txtStrings(exchange(t, newQuery(name, dns.TypeTXT)))
+		if len(strs) != 2 || !strings.HasPrefix(strs[1], "generated_at=") {
+			t.Fatalf("%s answered %q, want the answer then its timestamp", name, strs)
+		}
+		return strings.TrimPrefix(strs[1], "generated_at=")
+	}
+
+	before := time.Now().Unix()
+	generated := timestamp("what.is.go")
+	if at, err := strconv.ParseInt(generated, 10, 64); err != nil || at < before || at > time.Now().Unix() {
+		t.Errorf("generated at %s, want the time it was generated", generated)
+	}
+	if got := timestamp("what.is.go"); got != generated || calls.Load() != 1 {
+		t.Errorf("cached read reported %s after %d generations, want the original %s", got, calls.Load(), generated)
+	}
+
+	// An entry generated an hour ago reports that time on every read, not when it was read
+	createdAt := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+	c.Set(cacheEntry{key: cacheKey("what is dns"), response: "Cached earlier.", createdAt: createdAt, expiresAt: time.Now().Add(time.Hour)}, time.Hour)
+	setForTest(t, &includeTimestamp, timestampRFC3339)
+	for range 2 {
+		if got := timestamp("what.is.dns"); got != "2026-10-14T09:30:00Z" {
+			t.Errorf("cached entry reported %s, want its creation time", got)
+		}
+	}
+
+	// Persisting the cache keeps the creation time
+	path := t.TempDir() + "/cache.json"
+	if _, err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+	c = useFreshCache(t)
+	if _, err := c.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := timestamp("what.is.dns"); got != "2026-10-14T09:30:00Z" {
+		t.Errorf("reloaded entry reported %s, want its creation time", got)
+	}
+}
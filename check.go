@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// runSelfCheck checks the configuration of the provider and each secondary, makes a test LLM call to each, and
+// binds addr on each network without serving, printing a line per check to out. It returns whether every check passed.
+func runSelfCheck(ctx context.Context, out io.Writer, addr string, networks []string) bool {
+	passed := true
+	report := func(name string, err error) {
+		if err != nil {
+			passed = false
+			fmt.Fprintf(out, "FAIL %s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(out, "ok   %s\n", name)
+	}
+
+	checkProvider := func(name string, p LLMProvider) {
+		var configErr error
+		if c, ok := p.(configChecker); ok {
+			configErr = c.CheckConfig()
+		}
+		report(name+" configuration", configErr)
+		if configErr != nil {
+			// The call can't succeed without an API key, so don't spend a timeout finding that out
+			fmt.Fprintf(out, "skip test LLM call to %s\n", p.Model())
+			return
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, llmTimeout)
+		_, err := p.Generate(checkCtx, readyLLMCheckPrompt)
+		cancel()
+		report("test LLM call to "+p.Model(), err)
+	}
+	checkProvider("provider", provider)
+	// Secondaries are only used once the primary fails, which is the worst time to find one can't work
+	for i, p := range secondaryProviders {
+		checkProvider(fmt.Sprintf("secondary provider %d", i+1), p)
+	}
+
+	for _, n := range networks {
+		report("bind "+n+" "+addr, checkBind(n, addr))
+	}
+	return passed
+}
+
+// checkBind listens on addr and closes the listener straight away, catching ports in use or needing privileges
+func checkBind(network, addr string) error {
+	if strings.HasPrefix(network, "udp") {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
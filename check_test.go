@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSelfCheckFailsWithoutAPIKey(t *testing.T) {
+	var requests atomic.Int64
+	_, p := newOpenAIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		replyWith(openAIReply("ok"))(w, r)
+	})
+	useProvider(t, p)
+
+	var out strings.Builder
+	if !runSelfCheck(context.Background(), &out, "127.0.0.1:0", []string{"udp", "tcp"}) {
+		t.Fatalf("check failed with a working configuration:\n%s", out.String())
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("made %d test LLM calls, want 1", got)
+	}
+
+	p.apiKey = ""
+	out.Reset()
+	if runSelfCheck(context.Background(), &out, "127.0.0.1:0", []string{"udp", "tcp"}) {
+		t.Fatalf("check passed without an API key:\n%s", out.String())
+	}
+	report := out.String()
+	if !strings.Contains(report, "FAIL provider configuration: no API key") || !strings.Contains(report, "skip test LLM call") {
+		t.Errorf("report doesn't name the missing key:\n%s", report)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Error("made a test LLM call without an API key")
+	}
+	// The other checks still run, so one report covers everything that's wrong
+	if !strings.Contains(report, "ok   bind udp 127.0.0.1:0") {
+		t.Errorf("report skipped the bind checks:\n%s", report)
+	}
+}
+
+func TestSelfCheckFailsWithoutSecondaryAPIKey(t *testing.T) {
+	_, p := newOpenAIServer(t, replyWith(openAIReply("ok")))
+	useProvider(t, p)
+	secondary := &anthropicProvider{model: "claude-haiku-4-5"}
+	secondaryProviders = []LLMProvider{secondary}
+
+	var out strings.Builder
+	if runSelfCheck(context.Background(), &out, "127.0.0.1:0", []string{"udp"}) {
+		t.Fatalf("check passed with a secondary that has no API key:\n%s", out.String())
+	}
+	report := out.String()
+	if !strings.Contains(report, "FAIL secondary provider 1 configuration: no API key, set ANTHROPIC_API_KEY\n") {
+		t.Errorf("report doesn't name the secondary's missing key:\n%s", report)
+	}
+	if !strings.Contains(report, "ok   test LLM call to "+p.Model()) {
+		t.Errorf("report skipped the primary's test call:\n%s", report)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Signatures are valid from a little before they're made, allowing for clock skew between us and resolvers,
+// until well after the longest TTL they're likely to be cached for
+const (
+	signatureInceptionSkew = 1 * time.Hour
+	signatureValidity      = 7 * 24 * time.Hour
+)
+
+var (
+	// zoneKey is the public half of the zone signing key, served as the apex DNSKEY, nil when signing is disabled
+	zoneKey *dns.DNSKEY
+	// zoneSigner is the private half of zoneKey, signing replies online
+	zoneSigner crypto.Signer
+)
+
+// loadZoneKey reads a key pair in the format dnssec-keygen writes, Kzone.+alg+tag.key and .private, from
+// path with or without either extension
+func loadZoneKey(path string) (*dns.DNSKEY, crypto.Signer, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private")
+
+	f, err := os.Open(base + ".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, base+".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s.key holds a %s record, not a DNSKEY", base, dns.TypeToString[rr.Header().Rrtype])
+	}
+	if key.Flags&dns.ZONE == 0 {
+		return nil, nil, errors.New("key is not a zone key")
+	}
+
+	pf, err := os.Open(base + ".private")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pf.Close()
+	priv, err := key.ReadPrivateKey(pf, base+".private")
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("algorithm %s can't be used for signing", dns.AlgorithmToString[key.Algorithm])
+	}
+	key.Hdr.Ttl = staticTTL
+	return key, signer, nil
+}
+
+// staticDNSKEYRecord returns the zone's DNSKEY if q is a DNSKEY query for the zone apex, or nil otherwise
+func staticDNSKEYRecord(q dns.Question) dns.RR {
+	if zoneKey == nil || q.Qtype != dns.TypeDNSKEY || !isApex(q.Name) {
+		return nil
+	}
+	return zoneKey
+}
+
+// signingWriter signs every reply for a query that set the DNSSEC OK bit before writing it
+type signingWriter struct {
+	dns.ResponseWriter
+	r *dns.Msg
+}
+
+// newSigningWriter wraps w to sign replies to r, or returns w itself if signing is disabled or r didn't ask for it
+func newSigningWriter(w dns.ResponseWriter, r *dns.Msg) dns.ResponseWriter {
+	if zoneKey == nil {
+		return w
+	}
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		return w
+	}
+	return &signingWriter{ResponseWriter: w, r: r}
+}
+
+func (w *signingWriter) WriteMsg(m *dns.Msg) error {
+	// Truncated replies are only there to send the client to TCP, where it's answered in full
+	if m.Authoritative && !m.Truncated && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		if err := signReply(m); err != nil {
+			logger.Error("Failed to sign reply", "error", err)
+			m.Rcode = dns.RcodeServerFailure
+			m.Answer, m.Ns = nil, nil
+		}
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	}
+	// Signatures make replies much larger, so they're checked against the client's limit again
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok && m.Len() > maxUDPReplySize(w.r) {
+		m.Truncated = true
+		m.Answer, m.Ns = nil, nil
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// signReply adds RRSIGs for the records in m and, for negative replies, an NSEC proving the answer doesn't exist.
+// Since every name can be asked about, there's no zone to walk for real neighbours, so the NSEC only covers the
+// query name itself, and NXDOMAIN becomes NODATA for a name with no types, as other online signers do. This
+// avoids having to prove a wildcard doesn't exist, which can't be done without a signed list of names.
+func signReply(m *dns.Msg) error {
+	if len(m.Question) == 1 && len(m.Answer) == 0 {
+		q := m.Question[0]
+		types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+		if m.Rcode == dns.RcodeSuccess {
+			// Any other name in the zone answers TXT, only what's configured exists at the apex
+			types = append(types, dns.TypeTXT)
+			if isApex(q.Name) {
+				types = append(types, apexTypes()...)
+			}
+		}
+		types = slices.DeleteFunc(types, func(t uint16) bool { return t == q.Qtype })
+		slices.Sort(types)
+
+		name := dns.CanonicalName(q.Name)
+		m.Rcode = dns.RcodeSuccess
+		m.Ns = append(m.Ns, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: negativeTTLForNSEC()},
+			NextDomain: "\\000." + name,
+			TypeBitMap: types,
+		})
+	}
+
+	var err error
+	if m.Answer, err = signSection(m.Answer); err != nil {
+		return err
+	}
+	m.Ns, err = signSection(m.Ns)
+	return err
+}
+
+// apexTypes are the record types configured at the zone apex
+func apexTypes() []uint16 {
+	types := []uint16{dns.TypeDNSKEY}
+	if soaRecord != nil {
+		types = append(types, dns.TypeSOA)
+	}
+	if len(nsNames) > 0 {
+		types = append(types, dns.TypeNS)
+	}
+	if aRecord != nil {
+		types = append(types, dns.TypeA)
+	}
+	if aaaaRecord != nil {
+		types = append(types, dns.TypeAAAA)
+	}
+	return types
+}
+
+// negativeTTLForNSEC is how long an NSEC may be cached, the SOA's negative caching TTL as RFC 9077 asks
+func negativeTTLForNSEC() uint32 {
+	if soaRecord != nil {
+		return min(soaRecord.Hdr.Ttl, soaRecord.Minttl)
+	}
+	return staticTTL
+}
+
+// signSection returns rrs with an RRSIG following each RRset in the zone
+func signSection(rrs []dns.RR) ([]dns.RR, error) {
+	signed := make([]dns.RR, 0, 2*len(rrs))
+	now := time.Now()
+	for len(rrs) > 0 {
+		// An RRset is every record sharing a name and type, which our replies always keep together
+		h := rrs[0].Header()
+		n := 1
+		for n < len(rrs) && rrs[n].Header().Rrtype == h.Rrtype && strings.EqualFold(rrs[n].Header().Name, h.Name) {
+			n++
+		}
+		rrset := rrs[:n]
+		rrs = rrs[n:]
+		signed = append(signed, rrset...)
+		if h.Rrtype == dns.TypeRRSIG || !dns.IsSubDomain(zoneKey.Hdr.Name, h.Name) {
+			continue
+		}
+
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+			Algorithm:  zoneKey.Algorithm,
+			KeyTag:     zoneKey.KeyTag(),
+			SignerName: zoneKey.Hdr.Name,
+			Inception:  uint32(now.Add(-signatureInceptionSkew).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := sig.Sign(zoneSigner, rrset); err != nil {
+			return nil, fmt.Errorf("signing %s %s: %w", h.Name, dns.TypeToString[h.Rrtype], err)
+		}
+		signed = append(signed, sig)
+	}
+	return signed, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useZoneKey generates a zone signing key for zone and signs replies with it for the test
+func useZoneKey(t *testing.T, zone string) (*dns.DNSKEY, crypto.PrivateKey) {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: staticTTL},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &zoneKey, key)
+	setForTest(t, &zoneSigner, priv.(crypto.Signer))
+	return key, priv
+}
+
+// newDNSSECQuery builds a query for name and qtype setting the DNSSEC OK bit
+func newDNSSECQuery(name string, qtype uint16) *dns.Msg {
+	r := newQuery(name, qtype)
+	r.SetEdns0(4096, true)
+	return r
+}
+
+// verifyRRsets checks every RRset in rrs is followed by an RRSIG that verifies against key, returning how many
+func verifyRRsets(t *testing.T, key *dns.DNSKEY, rrs []dns.RR) int {
+	t.Helper()
+	verified := 0
+	for len(rrs) > 0 {
+		n := 1
+		for n < len(rrs) && rrs[n].Header().Rrtype == rrs[0].Header().Rrtype {
+			n++
+		}
+		rrset := rrs[:n]
+		rrs = rrs[n:]
+		if len(rrs) == 0 {
+			t.Errorf("%s %s has no RRSIG", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype])
+			return verified
+		}
+		sig, ok := rrs[0].(*dns.RRSIG)
+		if !ok {
+			t.Errorf("%s %s is followed by %v, not an RRSIG", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], rrs[0])
+			return verified
+		}
+		rrs = rrs[1:]
+		if err := sig.Verify(key, rrset); err != nil {
+			t.Errorf("RRSIG over %s %s doesn't verify: %v", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+		} else if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("RRSIG over %s %s isn't valid now", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype])
+		}
+		verified++
+	}
+	return verified
+}
+
+func TestSignedRepliesVerifyAgainstDNSKEY(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("A signed answer."))
+	setForTest(t, &zone, "chat.example.com.")
+	setForTest(t, &nondataResponse, nondataNoData)
+	useZoneKey(t, "chat.example.com.")
+
+	// Resolvers validate against the DNSKEY they're served, so check with that rather than the test's copy
+	m := exchangeTCP(t, newDNSSECQuery("chat.example.com", dns.TypeDNSKEY))
+	if len(m.Answer) == 0 {
+		t.Fatal("no DNSKEY at the apex")
+	}
+	key, ok := m.Answer[0].(*dns.DNSKEY)
+	if !ok {
+		t.Fatalf("apex DNSKEY query answered %v", m.Answer[0])
+	}
+	if got := verifyRRsets(t, key, m.Answer); got != 1 {
+		t.Errorf("verified %d RRsets in the DNSKEY answer, want 1", got)
+	}
+
+	m = exchangeTCP(t, newDNSSECQuery("What.Is.Go.chat.example.com", dns.TypeTXT))
+	if got := txtStrings(m); len(got) != 1 || got[0] != "A signed answer." {
+		t.Fatalf("answered %q", got)
+	}
+	if got := verifyRRsets(t, key, m.Answer); got != 1 {
+		t.Errorf("verified %d RRsets in the TXT answer, want 1", got)
+	}
+	if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("reply doesn't set the DO bit")
+	}
+
+	// The NSEC proving NODATA is signed too
+	m = exchangeTCP(t, newDNSSECQuery("what.is.go.chat.example.com", dns.TypeMX))
+	if got := verifyRRsets(t, key, m.Ns); got != 1 || m.Ns[0].Header().Rrtype != dns.TypeNSEC {
+		t.Errorf("NODATA authority %v, want a signed NSEC", m.Ns)
+	}
+
+	// Without the DO bit replies are left unsigned
+	m = exchangeTCP(t, newQuery("what.is.go.chat.example.com", dns.TypeTXT))
+	if len(m.Answer) != 1 {
+		t.Errorf("unsigned query got %d records, want the TXT alone", len(m.Answer))
+	}
+}
+
+func TestLoadZoneKey(t *testing.T) {
+	key, priv := useZoneKey(t, "chat.example.com.")
+	base := filepath.Join(t.TempDir(), "Kchat.example.com.+013+12345")
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{base, base + ".key", base + ".private"} {
+		loaded, signer, err := loadZoneKey(path)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+		if loaded.KeyTag() != key.KeyTag() || signer == nil {
+			t.Errorf("%s loaded key tag %d, want %d", filepath.Base(path), loaded.KeyTag(), key.KeyTag())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const readyLLMCheckInterval = 30 * time.Second
+
+// readyLLMCheckPrompt is sent by test LLM calls, short so they cost next to nothing
+const readyLLMCheckPrompt = "Reply with OK"
+
+var (
+	// listenersPending counts DNS listeners that haven't bound yet, set in main
+	listenersPending atomic.Int32
+	// llmCheckPassed is set once a test LLM call succeeds, or at startup when the check is disabled
+	llmCheckPassed atomic.Bool
+)
+
+// configChecker is implemented by providers that can report missing configuration, like an API key
+type configChecker interface {
+	CheckConfig() error
+}
+
+// checkReady returns why the server isn't ready to receive traffic, or nil if it is
+func checkReady() error {
+	if listenersPending.Load() > 0 {
+		return errors.New("DNS listener not bound")
+	}
+	if c, ok := provider.(configChecker); ok {
+		if err := c.CheckConfig(); err != nil {
+			return err
+		}
+	}
+	if !llmCheckPassed.Load() {
+		return errors.New("test LLM call has not succeeded")
+	}
+	return nil
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := checkReady(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// runReadyLLMCheck makes test LLM calls until one succeeds, proving the API key is valid
+func runReadyLLMCheck(ctx context.Context) {
+	ticker := time.NewTicker(readyLLMCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, llmTimeout)
+		_, err := provider.Generate(checkCtx, readyLLMCheckPrompt)
+		cancel()
+		if err == nil {
+			logger.Info("Test LLM call succeeded")
+			llmCheckPassed.Store(true)
+			return
+		}
+		logger.Warn("Test LLM call failed", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// knowledgeBase maps normalized prompts to curated answers, served instead of asking the LLM.
+// It's swapped whole when the file is reloaded, so lookups never see a half loaded file. Nil when unset.
+var knowledgeBase atomic.Pointer[map[string]string]
+
+// loadKnowledgeFile reads a JSON object mapping prompts, like "what is dnschat", to their answers. Prompts are
+// normalized like ones from queries, so they match however a client capitalizes or spaces the question.
+func loadKnowledgeFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	answers := make(map[string]string, len(raw))
+	for prompt, answer := range raw {
+		if answer == "" {
+			return nil, fmt.Errorf("empty answer for %q", prompt)
+		}
+		answers[normalizePrompt(prompt)] = answer
+	}
+	return answers, nil
+}
+
+// knowledgeAnswer returns the curated answer for q, if the knowledge base has one
+func knowledgeAnswer(q string) (string, bool) {
+	answers := knowledgeBase.Load()
+	if answers == nil {
+		return "", false
+	}
+	answer, ok := (*answers)[normalizePrompt(q)]
+	return answer, ok
+}
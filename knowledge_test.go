@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeKnowledge writes a knowledge file with content to a temporary directory, returning its path
+func writeKnowledge(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "knowledge.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useKnowledge loads the knowledge file at path for the test
+func useKnowledge(t *testing.T, path string) {
+	t.Helper()
+	answers, err := loadKnowledgeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := knowledgeBase.Load()
+	knowledgeBase.Store(&answers)
+	t.Cleanup(func() { knowledgeBase.Store(old) })
+}
+
+func TestKnownPromptNeverCallsLLM(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("From the LLM."))
+	useKnowledge(t, writeKnowledge(t, `{"What is  DNSChat": "An LLM you query over DNS."}`))
+
+	// Matched however the question is capitalized, spaced, or repeated
+	for _, name := range []string{"what.is.dnschat", "WHAT.IS.DNSCHAT", "what.is.dnschat"} {
+		if got := txtStrings(exchange(t, newQuery(name, dns.TypeTXT))); !slices.Equal(got, []string{"An LLM you query over DNS."}) {
+			t.Errorf("%s answered %q, want the curated answer", name, got)
+		}
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for a known prompt", got)
+	}
+
+	// Anything else falls through to the LLM
+	if got := txtStrings(exchange(t, newQuery("what.is.go", dns.TypeTXT))); !slices.Equal(got, []string{"From the LLM."}) {
+		t.Errorf("unknown prompt answered %q, want the LLM's answer", got)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want once for the unknown prompt", got)
+	}
+}
+
+func TestLoadKnowledgeFileRejectsInvalidFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"not JSON":     `what is dnschat: an answer`,
+		"empty answer": `{"what is dnschat": ""}`,
+		"not strings":  `{"what is dnschat": 42}`,
+	} {
+		if _, err := loadKnowledgeFile(writeKnowledge(t, content)); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}
@@ -1,67 +1,215 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const cacheDuration = 1 * time.Hour
+// Replies to queries for types other than TXT that don't have a static record
+const (
+	nondataNotImpl = "notimpl"
+	nondataNoData  = "nodata"
+)
+
+const (
+	// distributedLockPollInterval is how often a replica waiting on another's generation checks the cache
+	distributedLockPollInterval = 100 * time.Millisecond
+	// distributedLockSlack keeps a generation lock a little past the LLM timeout, covering caching the result
+	distributedLockSlack = 5 * time.Second
+)
+
+// defaultMaxUDPSize avoids IP fragmentation, as recommended by DNS Flag Day 2020
+const defaultMaxUDPSize = 1232
+
+// generateResponse produces the answer for a query that isn't cached, a variable so tests can
+// exercise caching and in-flight deduplication without calling an LLM
+var generateResponse = getLLMResponse
+
+var (
+	// errNegativeCached is returned when a recent generation for the same query failed
+	errNegativeCached = errors.New("upstream generation recently failed")
+	// errDedupTimeout is returned when waiting on an identical in-flight generation takes too long
+	errDedupTimeout = errors.New("timed out waiting for in-flight generation")
+	// errAnswerTooShort is returned when a generation is shorter than -min-answer
+	errAnswerTooShort = errors.New("LLM answer too short")
+)
 
-type cacheEntry struct {
-	response  string
+// llmResult is a response to a query along with its cache state
+type llmResult struct {
+	// answers are the candidate answers, only one unless -candidates is above 1
+	answers []string
+	cached  bool
+	// expiresAt is when the response leaves the cache, zero if it wasn't cached
 	expiresAt time.Time
+	// createdAt is when the response was generated, zero if it wasn't, like the fallback or a curated answer
+	createdAt time.Time
+	// fallback marks the -fallback-answer standing in for a failed generation
+	fallback bool
+	// stale marks an expired response served with -serve-stale while it's refreshed
+	stale bool
+	// pending marks a placeholder answer while the response is generated in the background with -async
+	pending bool
+	// curated marks an answer from the -knowledge-file rather than the LLM
+	curated bool
+}
+
+// inFlightRequest lets duplicate queries wait on, and share the result of, a generation that is already running
+type inFlightRequest struct {
+	done   chan struct{}
+	result llmResult
+	err    error
 }
 
 var (
-	logger     = slog.New(slog.NewTextHandler(os.Stdout, nil))
-	cache      = make(map[string]cacheEntry)
-	CacheMutex = &sync.RWMutex{}
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// dedupTimeout is how long a duplicate query waits on an in-flight generation
+	dedupTimeout = defaultLLMTimeout
+
+	// maxPromptLen is the most characters a decoded prompt can have, 0 means unlimited
+	maxPromptLen int
+
+	// minAnswerLen and maxAnswerLen bound generated answers in bytes, 0 means no bound
+	minAnswerLen int
+	maxAnswerLen int
+
+	// distributedLock has replicas sharing a cache backend take a lock so only one generates each response
+	distributedLock bool
+
+	// noCoalesce gives concurrent identical queries their own generations instead of sharing one
+	noCoalesce bool
+
+	// asyncAnswers answers cache misses with pendingAnswer straight away, generating in the background
+	asyncAnswers bool
+
+	// answerEncoding is how answers are written into TXT records, answerEncodingRaw or answerEncodingBase64
+	answerEncoding = answerEncodingRaw
+
+	// answerPrefix and answerSuffix frame every answer so clients can detect its boundaries
+	answerPrefix string
+	answerSuffix string
+
+	// fallbackAnswer is returned instead of SERVFAIL when generation fails, empty disables it
+	fallbackAnswer string
+
+	// redactPrompts hides questions in logs below debug level
+	redactPrompts = true
+
+	// maxInflightQueries caps queries being handled at once, 0 means unlimited
+	maxInflightQueries int
+	inflightQueries    atomic.Int64
+
+	// requestCounter makes every request ID unique
+	requestCounter atomic.Uint64
+	// appendRequestID adds the request ID to answers as an extra TXT string
+	appendRequestID bool
+
+	// debugAnswer adds whether the answer came from the cache as an extra TXT string
+	debugAnswer bool
+	// includeTimestamp adds when the answer was generated as an extra TXT string in this format, empty disables it
+	includeTimestamp string
+
+	// answerHMACKey signs every answer with an extra TXT string clients sharing it can verify, nil disables signing
+	answerHMACKey []byte
 
-	inFlightRequests = make(map[string]chan bool)
+	// canonicalOwner lowercases the owner name of answers instead of echoing the query's case
+	canonicalOwner bool
+
+	// multiRR splits long answers across several TXT records rather than one
+	multiRR bool
+
+	// maxStringsPerRR caps the character-strings in each TXT record, spilling the rest into more records,
+	// 0 means unlimited
+	maxStringsPerRR = defaultMaxStringsPerRR
+
+	// nondataResponse is how unsupported query types are answered, nondataNotImpl or nondataNoData
+	nondataResponse = nondataNotImpl
+
+	// maxUDPSize caps the EDNS0 buffer size we honour and advertise
+	maxUDPSize = defaultMaxUDPSize
+
+	// maxUDPAmplification caps UDP replies to queries without EDNS at this multiple of the query's size, 0 disables the cap
+	maxUDPAmplification float64
+
+	// answerTTL overrides the TTL on answers, when 0 the remaining cache lifetime is used
+	answerTTL time.Duration
+
+	inFlightRequests = make(map[string]*inFlightRequest)
 	inFlightMutex    = &sync.RWMutex{}
 )
 
 type dnsHandler struct{}
 
-func getCache(q string) (string, bool) {
-	CacheMutex.RLock()
-	defer CacheMutex.RUnlock()
-	res, ok := cache[q]
-	if ok && time.Now().Before(res.expiresAt) {
-		return res.response, true
+// newLogger builds a logger writing to stdout at the given level, in text or json format
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: must be debug, info, warn, or error", level)
 	}
-	return "", false
-}
 
-func setCache(q, res string) {
-	CacheMutex.Lock()
-	defer CacheMutex.Unlock()
-	cache[q] = cacheEntry{
-		response:  res,
-		expiresAt: time.Now().Add(cacheDuration),
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
 	}
 }
 
+// multiRRStrings is how many character-strings each TXT record holds with -multi-rr
+const multiRRStrings = 4
+
+// defaultMaxStringsPerRR keeps answers of up to about 16KB, 64 strings of 255 bytes, in a single TXT record.
+// That's more than fits in any UDP reply, but a TCP message can hold 64KB, so longer answers there spill into
+// more records.
+const defaultMaxStringsPerRR = 64
+
+// txtMaxStringLen is the longest character-string a TXT record can hold, as its length prefix is one byte
+const txtMaxStringLen = 255
+
+// chunkString splits s into chunks of at most chunkSize bytes without splitting a UTF-8 rune.
+// A rune is only ever larger than chunkSize when chunkSize is under 4, then it gets a chunk of its own.
+// An empty string gives a single empty chunk, as a TXT record must hold at least one character-string.
+// Empty LLM answers are rejected before they get here, but framing and extra strings still need a record.
 func chunkString(s string, chunkSize int) []string {
 	var chunks []string
 	var buf []byte
 
 	for i := 0; i < len(s); {
 		_, sz := utf8.DecodeRuneInString(s[i:])
-		if len(buf)+sz > chunkSize {
+		// Flush before a rune that would overflow the chunk, but never emit an empty chunk
+		if len(buf) > 0 && len(buf)+sz > chunkSize {
 			chunks = append(chunks, string(buf))
 			buf = buf[:0]
 		}
@@ -70,182 +218,1361 @@ func chunkString(s string, chunkSize int) []string {
 		i += sz
 	}
 
-	if len(buf) > 0 {
+	if len(buf) > 0 || len(chunks) == 0 {
 		chunks = append(chunks, string(buf))
 	}
 
 	return chunks
 }
 
+// Formats for the generation time added with -include-timestamp
+const (
+	timestampRFC3339 = "rfc3339"
+	timestampUnix    = "unix"
+)
+
+// formatTimestamp writes t in format, timestampRFC3339 in UTC or timestampUnix in seconds
+func formatTimestamp(t time.Time, format string) string {
+	if format == timestampUnix {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Encodings for answers in TXT records, selected with -answer-encoding
+const (
+	answerEncodingRaw    = "raw"
+	answerEncodingBase64 = "base64"
+)
+
+// encodeAnswer writes an answer in answerEncoding. Base64 answers aren't sanitized by cleanResponse, as the
+// encoding already keeps them to safe characters, so they carry the LLM's text as it was generated.
+func encodeAnswer(answer string) string {
+	if answerEncoding == answerEncodingBase64 {
+		return base64.StdEncoding.EncodeToString([]byte(answer))
+	}
+	return answer
+}
+
+// answerSignaturePrefix starts the TXT string holding an answer's signature
+const answerSignaturePrefix = "hmac-sha256="
+
+// answerSignature returns the TXT string signing answer as the reply to name with answerHMACKey. The lowercased
+// name is included, each followed by a newline, so a signed answer can't be replayed for a different question.
+func answerSignature(name, answer string) string {
+	mac := hmac.New(sha256.New, answerHMACKey)
+	mac.Write([]byte(dns.CanonicalName(name) + "\n" + answer))
+	return answerSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// cleanResponse enforces the character set the system prompt asks for, A-Z, a-z, 0-9, spaces, commas,
+// periods, and question marks. Whitespace such as newlines and tabs becomes a single space and
+// anything else, like emoji or control characters, is dropped.
 func cleanResponse(text string) string {
-	text = strings.ReplaceAll(text, "\n", " ")
-	text = strings.ReplaceAll(text, "\r", " ")
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r == ' ', r == ',', r == '.', r == '?':
+			return r
+		case unicode.IsSpace(r):
+			return ' '
+		default:
+			return -1
+		}
+	}, text)
 
-	return text
+	return strings.Join(strings.Fields(text), " ")
 }
 
-func getLLMResponse(q string) (string, error) {
-	body := map[string]string{
-		"model": "gpt-5-nano",
-		"input": "Answer as quickly as possible and concisely max 3 sentences Use only A-Z, a-z, 0-9, and spaces, commas, periods, and question marks. No extra formatting.:" + q,
+// pendingAnswer is returned with -async while the answer to a query is being generated
+const pendingAnswer = "status=pending"
+
+// getOrCreateLLMRequest returns the response for q, from the cache if possible. When async is set, a cache miss
+// starts generating in the background and returns a pending result instead of waiting.
+func getOrCreateLLMRequest(ctx context.Context, q string, async bool) (result llmResult, err error) {
+	ctx, span := tracer.Start(ctx, "getOrCreateLLMRequest", trace.WithAttributes(attribute.String("dnschat.prompt", redactPrompt(q))))
+	defer func() {
+		span.SetAttributes(attribute.Bool("dnschat.cache_hit", result.cached))
+		endSpan(span, err)
+	}()
+
+	// Curated answers are always right and free, so they're served ahead of anything the LLM said
+	if answer, ok := knowledgeAnswer(q); ok {
+		span.SetAttributes(attribute.Bool("dnschat.curated", true))
+		return llmResult{answers: []string{answer}, curated: true}, nil
 	}
-	jsonBody, _ := json.Marshal(body)
-	bodyReader := bytes.NewReader(jsonBody)
-	r, err := http.NewRequest("POST", "https://api.openai.com/v1/responses", bodyReader)
-	if err != nil {
-		logger.Error("Error creating request", "error", err)
-		return "", err
+
+	// Key on the configuration too, so answers from another model or system prompt aren't served
+	key := cacheKey(q)
+	entry, state := getCacheEntry(key)
+	switch {
+	case state == cacheFresh && entry.failed:
+		return llmResult{}, errNegativeCached
+	case state == cacheFresh:
+		return llmResult{answers: splitCandidates(entry.response), cached: true, expiresAt: entry.expiresAt, createdAt: entry.createdAt}, nil
+	case state == cacheStale:
+		// Answer immediately with the expired response, refreshing it for the queries that follow
+		span.SetAttributes(attribute.Bool("dnschat.stale", true))
+		refreshStale(key, q)
+		return llmResult{answers: splitCandidates(entry.response), cached: true, stale: true, createdAt: entry.createdAt}, nil
 	}
 
-	r.Header.Set("Authorization", "Bearer "+os.Getenv("OPENAI_API_KEY"))
+	if async {
+		span.SetAttributes(attribute.Bool("dnschat.pending", true))
+		startAsyncGeneration(key, q)
+		return llmResult{answers: []string{pendingAnswer}, pending: true}, nil
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(r)
-	if err != nil {
-		logger.Error("Error sending request", "error", err)
-		return "", err
+	// Without coalescing every query that misses the cache gets its own generation
+	if noCoalesce {
+		result, err = generateShared(ctx, key, q)
+		return result, err
 	}
-	defer resp.Body.Close()
 
-	var result map[string]any
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		logger.Error("Error decoding response", "error", err)
-		return "", err
+	// If this request is already in flight, wait for it to complete instead of creating a new request
+	inFlightMutex.Lock()
+	req, ok := inFlightRequests[key]
+	if ok {
+		inFlightMutex.Unlock()
+		inFlightDedupTotal.Inc()
+		span.SetAttributes(attribute.Bool("dnschat.deduplicated", true))
+		// No matter if the request succeeded or not, the channel will be closed, letting us continue here
+		// The result is shared through the request rather than the cache, so this works with caching disabled.
+		// Give up if the leader stalls, so one slow upstream call can't hang every duplicate query.
+		timer := time.NewTimer(dedupTimeout)
+		defer timer.Stop()
+		select {
+		case <-req.done:
+		case <-timer.C:
+			return llmResult{}, errDedupTimeout
+		}
+		if req.err != nil {
+			return llmResult{}, fmt.Errorf("upstream generation failed: %w", req.err)
+		}
+		return req.result, nil
 	}
 
-	logger.Info("Full LLM Response", "response", result)
+	req = &inFlightRequest{done: make(chan struct{})}
+	inFlightRequests[key] = req
+	inFlightMutex.Unlock()
+
+	// The generation is shared with every query coalesced onto it, so it's detached from this caller: an HTTP
+	// client hanging up only gives up its own wait, and the generation stays bounded by llmTimeout.
+	// Important to set the cache before removing the request from the inFlightRequests map
+	// Otherwise, can have race condition where new request comes in before the cache is set,
+	// and it will create a new LLM request.
+	go func() {
+		req.result, req.err = generateShared(context.WithoutCancel(ctx), key, q)
+		finishInFlight(key, req)
+	}()
+	select {
+	case <-req.done:
+	case <-ctx.Done():
+		return llmResult{}, ctx.Err()
+	}
+	return req.result, req.err
+}
 
-	// Extract from output[1].content[0].text
-	if output, ok := result["output"].([]any); ok && len(output) > 1 {
-		if secondOutput, ok := output[1].(map[string]any); ok {
-			if content, ok := secondOutput["content"].([]any); ok && len(content) > 0 {
-				if firstContent, ok := content[0].(map[string]any); ok {
-					if text, ok := firstContent["text"].(string); ok {
-						return cleanResponse(text), nil
-					}
-				}
+// generateShared generates and caches the response for q, but with distributedLock only on the replica that
+// holds the backend's lock for key. Other replicas poll the shared cache for its result, and take over if the
+// lock is released or expires without one, as when caching is disabled or the holder died.
+func generateShared(ctx context.Context, key, q string) (llmResult, error) {
+	locker, ok := responseCache.(cacheLocker)
+	if !distributedLock || !ok {
+		return generateAndCache(ctx, key, q)
+	}
+
+	deadline := time.Now().Add(dedupTimeout)
+	for {
+		// The lock outlives the generation's whole budget, so it only expires if its holder is gone
+		if token, acquired := locker.TryLock(key, llmTimeout+distributedLockSlack); acquired {
+			defer locker.Unlock(key, token)
+			return generateAndCache(ctx, key, q)
+		}
+
+		select {
+		case <-ctx.Done():
+			return llmResult{}, ctx.Err()
+		case <-time.After(distributedLockPollInterval):
+		}
+		if entry, ok := responseCache.Get(key); ok && time.Now().Before(entry.expiresAt) {
+			inFlightDedupTotal.Inc()
+			if entry.failed {
+				return llmResult{}, errNegativeCached
 			}
+			return llmResult{answers: splitCandidates(entry.response), cached: true, expiresAt: entry.expiresAt, createdAt: entry.createdAt}, nil
+		}
+		if time.Now().After(deadline) {
+			return llmResult{}, errDedupTimeout
 		}
 	}
+}
 
-	return "", errors.New("could not read response from LLM")
+// finishInFlight removes a completed request from inFlightRequests and closes it so waiters can continue
+func finishInFlight(key string, req *inFlightRequest) {
+	inFlightMutex.Lock()
+	delete(inFlightRequests, key)
+	inFlightMutex.Unlock()
+	close(req.done)
 }
 
-func getOrCreateLLMRequest(q string) (string, error) {
-	response, ok := getCache(q)
-	if ok {
-		return response, nil
+// refreshStale regenerates a stale cache entry in the background, unless a generation for it is already running.
+// A failed refresh leaves the stale entry in place rather than negatively caching, so it can keep being served.
+func refreshStale(key, q string) {
+	inFlightMutex.Lock()
+	if _, ok := inFlightRequests[key]; ok {
+		inFlightMutex.Unlock()
+		return
 	}
+	req := &inFlightRequest{done: make(chan struct{})}
+	inFlightRequests[key] = req
+	inFlightMutex.Unlock()
 
-	// If this request is already in flight, wait for it to complete instead of creating a new request
+	go func() {
+		// Detached from the query, which is answered before the refresh finishes
+		req.result.answers, req.err = generate(context.Background(), q)
+		if req.err != nil {
+			logger.Warn("Failed to refresh stale cache entry", "question", redactPrompt(q), "error", req.err)
+		} else {
+			req.result.createdAt = time.Now()
+			req.result.expiresAt = setCache(key, req.result.answers, req.result.createdAt, cacheTTL)
+		}
+		finishInFlight(key, req)
+	}()
+}
+
+// startAsyncGeneration generates and caches the response for q in the background, unless a generation for it is
+// already running. Queries polling for it are answered from the cache once it's done, failures included.
+func startAsyncGeneration(key, q string) {
 	inFlightMutex.Lock()
-	ch, ok := inFlightRequests[q]
-	if ok {
+	if _, ok := inFlightRequests[key]; ok {
 		inFlightMutex.Unlock()
-		// No matter if the request succeeded or not, the channel will be closed, letting us continue here
-		// If it failed the cache will not be set, so we need to check ok to see if the request failed.
-		<-ch
-		response, ok := getCache(q)
+		return
+	}
+	req := &inFlightRequest{done: make(chan struct{})}
+	inFlightRequests[key] = req
+	inFlightMutex.Unlock()
 
-		if !ok {
-			return "", errors.New("upstream generation failed")
+	go func() {
+		// Detached from the query, which is answered before the generation finishes
+		req.result, req.err = generateShared(context.Background(), key, q)
+		if req.err != nil {
+			logger.Warn("Failed to generate response in the background", "question", redactPrompt(q), "error", req.err)
 		}
-		return response, nil
+		finishInFlight(key, req)
+	}()
+}
+
+// buildTXTAnswer puts chunks into TXT records of at most perRR character-strings each, in order.
+// A perRR of 0 or less puts every chunk in a single record.
+func buildTXTAnswer(name string, ttl uint32, chunks []string, perRR int) []dns.RR {
+	if perRR <= 0 {
+		perRR = max(len(chunks), 1)
 	}
 
-	ch = make(chan bool)
-	inFlightRequests[q] = ch
-	inFlightMutex.Unlock()
+	var reply []dns.RR
+	for i := 0; i < len(chunks) || i == 0; i += perRR {
+		rr := &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Txt: chunks[i:min(i+perRR, len(chunks))],
+		}
+		reply = append(reply, rr)
+	}
+	return reply
+}
+
+// safeGenerate calls generateResponse, turning a panic into an error so the leader of an in-flight
+// request still cleans up and its waiters aren't wedged forever
+func safeGenerate(ctx context.Context, q string) (answers []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Panic while generating response", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic while generating response: %v", r)
+		}
+	}()
+	return generateResponse(ctx, q)
+}
+
+// applyAnswerBounds drops candidate answers shorter than minAnswerLen, likely refusals or errors, failing if none
+// are left, and truncates candidates longer than maxAnswerLen bytes at a rune boundary
+func applyAnswerBounds(answers []string) ([]string, error) {
+	var kept []string
+	for _, candidate := range answers {
+		if len(candidate) < minAnswerLen {
+			logger.Warn("LLM answer too short", "length", len(candidate), "min", minAnswerLen)
+			continue
+		}
+		if maxAnswerLen > 0 && len(candidate) > maxAnswerLen {
+			cut := maxAnswerLen
+			for cut > 0 && !utf8.RuneStart(candidate[cut]) {
+				cut--
+			}
+			candidate = candidate[:cut]
+		}
+		kept = append(kept, candidate)
+	}
+	if len(kept) == 0 {
+		return nil, errAnswerTooShort
+	}
+	return kept, nil
+}
+
+// joinCandidates joins candidate answers into the single response a cache entry holds
+func joinCandidates(answers []string) string {
+	return strings.Join(answers, candidateSeparator)
+}
 
-	response, err := getLLMResponse(q)
+// splitCandidates splits a cached response back into its candidate answers, there's only one unless -candidates
+// is above 1. A single answer isn't split, as an unsanitized one may contain the separator itself.
+func splitCandidates(response string) []string {
+	if llmCandidates <= 1 {
+		return []string{response}
+	}
+	return strings.Split(response, candidateSeparator)
+}
 
-	// If the request failed, return the error, for the server, close the channel so waiters can continue
+// generate produces the candidate answers for q, within the -min-answer and -max-answer bounds
+func generate(ctx context.Context, q string) ([]string, error) {
+	answers, err := safeGenerate(ctx, q)
 	if err != nil {
-		close(ch)
-		return "", err
+		return nil, err
 	}
+	return applyAnswerBounds(answers)
+}
 
-	// Important to set the cache before removing the request from the inFlightRequests map
-	// Otherwise, can have race condition where new request comes in before the cache is set,
-	// and it will create a new LLM request.
-	setCache(q, response)
-	inFlightMutex.Lock()
-	delete(inFlightRequests, q)
-	inFlightMutex.Unlock()
+// generateAndCache generates the response for q and caches the outcome under key
+func generateAndCache(ctx context.Context, key, q string) (llmResult, error) {
+	var result llmResult
+	var err error
+	result.answers, err = generate(ctx, q)
+	if err != nil {
+		// Remember the failure briefly so repeated queries don't stampede a flaky upstream.
+		// Running out of budget isn't the upstream's fault, and clears by itself at midnight. The circuit
+		// breaker already fails fast, and its entries would outlive it closing again. A caller giving up
+		// says nothing about the upstream either.
+		if !errors.Is(err, errBudgetExhausted) && !errors.Is(err, errCircuitOpen) && !errors.Is(err, context.Canceled) {
+			setNegativeCache(key, negativeTTL)
+		}
+		return result, err
+	}
+	result.createdAt = time.Now()
+	result.expiresAt = setCache(key, result.answers, result.createdAt, cacheTTL)
+	return result, nil
+}
 
-	// Close the channel so waiters can continue
-	close(ch)
+// answerTTLFor returns the TTL to put on an answer, so caching resolvers hold it no longer than we do
+func answerTTLFor(result llmResult) uint32 {
+	// Resolvers shouldn't hold on to the fallback or a pending answer, so they ask again for the real one
+	if result.fallback || result.pending {
+		return 0
+	}
+	if result.stale {
+		return uint32(staleAnswerTTL / time.Second)
+	}
+	if answerTTL > 0 {
+		return uint32(answerTTL / time.Second)
+	}
+	if result.curated {
+		return staticTTL
+	}
+	if result.expiresAt.IsZero() {
+		return 0
+	}
+	return uint32(max(0, time.Until(result.expiresAt)) / time.Second)
+}
 
-	return response, nil
+// udpSize returns the largest UDP message to send the client, using the EDNS0 buffer size if advertised,
+// clamped to maxUDPSize so large answers aren't fragmented
+func udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return min(int(opt.UDPSize()), maxUDPSize)
+	}
+	return dns.MinMsgSize
+}
+
+// maxUDPReplySize is the largest answer to send r over UDP. Without EDNS it's further limited by
+// maxUDPAmplification so a small spoofed query can't be used to send a much larger reply to a victim,
+// clients advertising a larger buffer are trusted with it.
+func maxUDPReplySize(r *dns.Msg) int {
+	size := udpSize(r)
+	if maxUDPAmplification > 0 && r.IsEdns0() == nil {
+		size = min(size, int(float64(r.Len())*maxUDPAmplification))
+	}
+	return size
+}
+
+// truncateForUDP sets the TC bit and drops the answer if m doesn't fit in maxUDPReplySize(r) and is going
+// out over UDP, so the resolver retries over TCP, where the source address can't be spoofed. It returns
+// whether m was truncated.
+func truncateForUDP(w dns.ResponseWriter, r, m *dns.Msg) bool {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok || m.Len() <= maxUDPReplySize(r) {
+		return false
+	}
+	m.Truncated = true
+	m.Answer = nil
+	return true
+}
+
+// newReply creates a reply to r, echoing an OPT record advertising our buffer size if the client used EDNS0.
+// Replies for names in our zone are authoritative, and recursion is never offered as we don't recurse.
+func newReply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = len(r.Question) == 1 && inZone(r.Question[0].Name)
+	m.RecursionAvailable = false
+	if r.IsEdns0() != nil {
+		m.SetEdns0(uint16(udpSize(r)), false)
+	}
+	return m
+}
+
+// redactPrompt replaces a query name or prompt with a short hash for logging when redactPrompts is set,
+// so logs can still correlate repeats of a question without recording what was asked
+func redactPrompt(s string) string {
+	if !redactPrompts {
+		return s
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(s)))
+	return fmt.Sprintf("redacted:%x", sum[:4])
+}
+
+// newRequestID returns a short ID for correlating a query with the logs, the DNS message ID
+// followed by a per-process counter so IDs are unique even when clients reuse message IDs
+func newRequestID(msgID uint16) string {
+	return fmt.Sprintf("%04x-%x", msgID, requestCounter.Add(1))
+}
+
+// requestIDKey is the context key for the request ID, so logs deep in generation can include it
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying the request ID id
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID ctx carries, or an empty string if it has none
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// writeRcode replies to r with an empty answer and the given rcode
+func writeRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	m := newReply(r)
+	m.Rcode = rcode
+	w.WriteMsg(m)
+}
+
+// writeExtendedError replies to r with the given rcode and, for EDNS clients, an RFC 8914
+// Extended DNS Error explaining why. Clients without EDNS can't receive an OPT record.
+func writeExtendedError(w dns.ResponseWriter, r *dns.Msg, rcode int, infoCode uint16, text string) {
+	m := newReply(r)
+	m.Rcode = rcode
+	if opt := m.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: infoCode, ExtraText: text})
+	}
+	w.WriteMsg(m)
+}
+
+// extendedErrorFor maps a generation error to the Extended DNS Error info-code and text clients see
+func extendedErrorFor(err error) (uint16, string) {
+	var se *statusError
+	var ue *url.Error
+	switch {
+	case errors.Is(err, errNegativeCached):
+		return dns.ExtendedErrorCodeCachedError, "upstream recently failed"
+	case errors.Is(err, ErrEmptyAnswer):
+		return dns.ExtendedErrorCodeInvalidData, "upstream returned an empty answer"
+	case errors.Is(err, ErrBadResponse):
+		return dns.ExtendedErrorCodeInvalidData, "upstream returned an unreadable response"
+	case errors.Is(err, errBudgetExhausted):
+		return dns.ExtendedErrorCodeProhibited, "daily token budget exhausted"
+	case errors.Is(err, errCircuitOpen):
+		return dns.ExtendedErrorCodeNotReady, "upstream failing, not calling it for now"
+	case errors.Is(err, errAnswerTooShort):
+		return dns.ExtendedErrorCodeInvalidData, "upstream answer too short"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errDedupTimeout):
+		return dns.ExtendedErrorCodeNoReachableAuthority, "upstream timed out"
+	case errors.As(err, &se) && se.StatusCode == http.StatusTooManyRequests:
+		return dns.ExtendedErrorCodeOther, "upstream rate limited"
+	case errors.As(err, &se):
+		return dns.ExtendedErrorCodeOther, fmt.Sprintf("upstream returned status %d", se.StatusCode)
+	case errors.As(err, &ue):
+		return dns.ExtendedErrorCodeNetworkError, "upstream unreachable"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return dns.ExtendedErrorCodeNoReachableAuthority, "upstream unavailable"
+	default:
+		return dns.ExtendedErrorCodeOther, "could not generate answer"
+	}
 }
 
 func (h *dnsHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	h.handleDNSRequest(w, r)
+	h.handleDNSRequest(newSigningWriter(w, r), r)
 }
 
 func (h *dnsHandler) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	if len(r.Question) == 0 {
-		logger.Error("No questions in request")
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Rcode = dns.RcodeServerFailure
-		w.WriteMsg(m)
+	// A response sent to us is dropped rather than answered, so two servers can't be made to bounce replies
+	// at each other. miekg/dns's default accept func already ignores these, this guards other callers.
+	if r.Response {
+		logger.Warn("Dropping message with the QR bit set", "client", clientIP(w.RemoteAddr()))
+		return
+	}
+
+	// Admission control comes first, so a flood can't pile up handler goroutines waiting on the LLM
+	if maxInflightQueries > 0 {
+		if inflightQueries.Add(1) > int64(maxInflightQueries) {
+			inflightQueries.Add(-1)
+			logger.Warn("Too many in-flight queries", "max", maxInflightQueries)
+			writeExtendedError(w, r, dns.RcodeRefused, dns.ExtendedErrorCodeOther, "server busy")
+			return
+		}
+		defer inflightQueries.Add(-1)
+	}
+
+	client := clientIP(w.RemoteAddr())
+	if !clientAllowed(client) {
+		logger.Warn("Client not allowed", "client", client)
+		writeExtendedError(w, r, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "client not allowed")
+		return
+	}
+
+	// Queries must have exactly one question, rather than silently answering only the first
+	if len(r.Question) != 1 {
+		logger.Warn("Expected exactly one question in request", "questions", len(r.Question))
+		writeRcode(w, r, dns.RcodeFormatError)
 		return
 	}
 
+	start := time.Now()
 	q := r.Question[0]
-	logger.Info("Received DNS request", "question", q.Name)
+	ctx, span := tracer.Start(context.Background(), "handleDNSRequest", trace.WithAttributes(
+		attribute.String("dns.question.name", redactPrompt(q.Name)),
+		attribute.String("dns.question.type", dns.TypeToString[q.Qtype]),
+	))
+	defer span.End()
+	requestID := newRequestID(r.Id)
+	ctx = withRequestID(ctx, requestID)
+	reqLogger := logger.With("request_id", requestID, "question", redactPrompt(NormalizeName(q.Name)), "client", client)
+	reqLogger.Info("Received DNS request", "type", dns.TypeToString[q.Qtype])
+	reqLogger.Debug("Unredacted question", "name", NormalizeName(q.Name))
+	queriesTotal.Inc()
 
-	if q.Qtype != dns.TypeTXT {
-		logger.Error("Unsupported DNS type", "type", q.Qtype)
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Rcode = dns.RcodeNotImplemented
+	if limiter != nil && !limiter.Allow(client) {
+		reqLogger.Warn("Client rate limited")
+		writeRateLimited(w, r, client)
+		return
+	}
+
+	// Only answer for names in our zone, so the server can't be used as an open generator
+	if !inZone(q.Name) {
+		reqLogger.Warn("Query outside of zone", "zone", zone)
+		writeRcode(w, r, dns.RcodeNameError)
+		return
+	}
+
+	// A CNAME applies to every type, so redirected names are checked before anything else
+	if rr := staticCNAMERecord(q); rr != nil {
+		m := newReply(r)
+		m.Answer = []dns.RR{rr}
 		w.WriteMsg(m)
+		reqLogger.Info("Answered with CNAME", "target", rr.(*dns.CNAME).Target, "latency", time.Since(start))
 		return
 	}
 
-	response, err := getOrCreateLLMRequest(q.Name)
-	if err != nil {
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Rcode = dns.RcodeServerFailure
+	if records := staticNSRecords(q); records != nil {
+		m := newReply(r)
+		m.Answer = records
 		w.WriteMsg(m)
+		reqLogger.Info("Answered with NS", "latency", time.Since(start))
 		return
 	}
 
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Rcode = dns.RcodeSuccess
+	if rr := staticSOARecord(q); rr != nil {
+		m := newReply(r)
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+		reqLogger.Info("Answered with SOA", "latency", time.Since(start))
+		return
+	}
+
+	if rr := staticDNSKEYRecord(q); rr != nil {
+		m := newReply(r)
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+		reqLogger.Info("Answered with DNSKEY", "latency", time.Since(start))
+		return
+	}
+
+	if rr := staticAddressRecord(q); rr != nil {
+		m := newReply(r)
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+		reqLogger.Info("Answered with static address", "latency", time.Since(start))
+		return
+	}
+
+	if isStatsQuery(q) {
+		if ip := net.ParseIP(client); ip == nil || !containsIP(statsAllowNets, ip) {
+			reqLogger.Warn("Client not allowed to query stats")
+			writeExtendedError(w, r, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "stats not allowed")
+			return
+		}
+		m := newReply(r)
+		m.Answer = []dns.RR{statsRecord(q)}
+		w.WriteMsg(m)
+		reqLogger.Info("Answered with stats", "latency", time.Since(start))
+		return
+	}
 
-	reply := []dns.RR{}
-	chunks := chunkString(response, 255)
+	// Meta-queries about the service itself are answered without spending a generation
+	if rr := staticAboutRecord(q); rr != nil {
+		m := newReply(r)
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+		reqLogger.Info("Answered with identity record", "latency", time.Since(start))
+		return
+	}
+
+	if q.Qtype != dns.TypeTXT {
+		reqLogger.Warn("Unsupported DNS type", "type", q.Qtype)
+		// NODATA tells the resolver the name exists but has no records of this type
+		if nondataResponse == nondataNoData {
+			writeNegative(w, r, dns.RcodeSuccess)
+			return
+		}
+		writeRcode(w, r, dns.RcodeNotImplemented)
+		return
+	}
+
+	// In paging mode the first label picks a chunk, and the rest of the name is the question
+	name, cursor := q.Name, 0
+	if paging {
+		var err error
+		cursor, name, err = splitCursor(q.Name)
+		if err != nil {
+			reqLogger.Warn("Could not parse paging cursor", "error", err)
+			writeRcode(w, r, dns.RcodeFormatError)
+			return
+		}
+	}
 
-	rr := &dns.TXT{
-		Hdr: dns.RR_Header{
-			Name:   q.Name,
-			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET,
-		},
-		Txt: chunks,
+	// With sessions the next label is the session ID, whose history is added to the prompt
+	var sessionID string
+	if sessionsEnabled {
+		var ok bool
+		sessionID, name, ok = splitFirstLabel(name)
+		if !ok {
+			reqLogger.Warn("Session query has no question after the session ID")
+			writeRcode(w, r, dns.RcodeFormatError)
+			return
+		}
+		sessionID = strings.ToLower(sessionID)
+	}
+
+	prompt, err := queryToPrompt(name, zone, queryEncoding)
+	if err != nil {
+		reqLogger.Warn("Could not decode query", "error", err)
+		writeRcode(w, r, dns.RcodeFormatError)
+		return
+	}
+
+	// Checked after decoding so the limit is on prompt characters rather than encoded bytes
+	if maxPromptLen > 0 && utf8.RuneCountInString(prompt) > maxPromptLen {
+		reqLogger.Warn("Prompt too long", "length", utf8.RuneCountInString(prompt), "max", maxPromptLen)
+		writeExtendedError(w, r, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "prompt too long")
+		return
+	}
+
+	// Refuse before generating, so abusive prompts never cost an LLM call
+	if promptBlocklist.Load().blocked(prompt) {
+		reqLogger.Warn("Prompt blocked")
+		writeExtendedError(w, r, dns.RcodeRefused, dns.ExtendedErrorCodeBlocked, "prompt blocked")
+		return
+	}
+
+	question := prompt
+	if sessionsEnabled {
+		prompt = sessionPrompt(sessionID, question)
+	}
+
+	result, err := getOrCreateLLMRequest(ctx, prompt, asyncAnswers)
+	if err != nil && fallbackAnswer != "" {
+		// Failures are already retried and negatively cached below here, the fallback only changes what the client sees
+		reqLogger.Error("Failed to generate response, answering with fallback", "error", err, "latency", time.Since(start))
+		result, err = llmResult{answers: []string{fallbackAnswer}, fallback: true}, nil
+	} else if errors.Is(err, errBudgetExhausted) {
+		reqLogger.Warn("Refusing query as the daily token budget is exhausted")
+		infoCode, text := extendedErrorFor(err)
+		writeExtendedError(w, r, dns.RcodeRefused, infoCode, text)
+		return
+	} else if err != nil {
+		reqLogger.Error("Failed to generate response", "error", err, "latency", time.Since(start))
+		infoCode, text := extendedErrorFor(err)
+		writeExtendedError(w, r, dns.RcodeServerFailure, infoCode, text)
+		return
+	}
+	if sessionsEnabled && !result.fallback && !result.pending {
+		recordSessionTurn(sessionID, question, prompt, result.answers[0])
+	}
+
+	m := newReply(r)
+	m.Rcode = dns.RcodeSuccess
+
+	var extras []string
+	if appendRequestID {
+		extras = append(extras, "request_id="+requestID)
+	}
+	if debugAnswer {
+		if result.curated {
+			extras = append(extras, "cache=knowledge")
+		} else if result.stale {
+			extras = append(extras, "cache=stale")
+		} else if result.cached {
+			extras = append(extras, "cache=hit")
+		} else {
+			extras = append(extras, "cache=miss")
+		}
+	}
+	if includeTimestamp != "" && !result.createdAt.IsZero() {
+		extras = append(extras, "generated_at="+formatTimestamp(result.createdAt, includeTimestamp))
+	}
+	perRR := maxStringsPerRR
+	if multiRR {
+		perRR = multiRRStrings
+		if maxStringsPerRR > 0 {
+			perRR = min(perRR, maxStringsPerRR)
+		}
+	}
+	ttl := answerTTLFor(result)
+	// Answer with the name exactly as the client sent it, not the lowercased form used for caching,
+	// as resolvers using DNS 0x20 reject answers whose case doesn't match their query
+	owner := q.Name
+	if canonicalOwner {
+		owner = dns.CanonicalName(q.Name)
+	}
+	// Each candidate answer gets its own TXT record, with any extra strings repeated so every record stands alone
+	for _, candidate := range result.answers {
+		// Frame before chunking so the markers are split consistently with the rest of the answer
+		chunks := chunkString(answerPrefix+encodeAnswer(candidate)+answerSuffix, txtMaxStringLen)
+		if paging {
+			if cursor >= len(chunks) {
+				reqLogger.Info("Paging cursor past the end of the answer", "cursor", cursor, "chunks", len(chunks))
+				writeNegative(w, r, dns.RcodeNameError)
+				return
+			}
+			chunks = chunks[cursor : cursor+1]
+		}
+		// Sign exactly what this record carries, so a client can check it without undoing any of the framing
+		if answerHMACKey != nil {
+			chunks = append(chunks, answerSignature(q.Name, strings.Join(chunks, "")))
+		}
+		chunks = append(chunks, extras...)
+		m.Answer = append(m.Answer, buildTXTAnswer(owner, ttl, chunks, perRR)...)
 	}
 
-	reply = append(reply, rr)
+	// If the answer doesn't fit in the client's UDP buffer, or is too many times larger than the query,
+	// the resolver is told to retry over TCP
+	if size := m.Len(); truncateForUDP(w, r, m) {
+		reqLogger.Info("Answer too large for UDP, truncating", "size", size, "max", maxUDPReplySize(r))
+	}
 
-	m.Answer = reply
 	w.WriteMsg(m)
+	reqLogger.Info("Answered DNS request", "cache_hit", result.cached, "latency", time.Since(start))
+}
+
+// withIPVersion returns networks restricted to the IP version listened on: unchanged for any, so the OS decides
+// whether a wildcard address is dual-stack, suffixed with 4 or 6 for a single version, and both suffixes for both,
+// which binds IPv6 sockets as IPv6 only so they can share the port with IPv4 ones
+func withIPVersion(networks []string, version, listenAddr string) ([]string, error) {
+	var suffixes []string
+	switch version {
+	case "any":
+		return networks, nil
+	case "4", "6":
+		suffixes = []string{version}
+	case "both":
+		if listenAddr != "" {
+			return nil, errors.New("both needs -addr unset, as an address only has one version")
+		}
+		suffixes = []string{"4", "6"}
+	default:
+		return nil, errors.New("must be 4, 6, both, or any")
+	}
+	// A hostname is left to resolve when binding, which fails if it has no address of the version
+	if ip, err := netip.ParseAddr(listenAddr); err == nil && (ip.Unmap().Is4() != (version == "4")) {
+		return nil, fmt.Errorf("-addr %s is not an IPv%s address", listenAddr, version)
+	}
 
+	versioned := make([]string, 0, len(networks)*len(suffixes))
+	for _, n := range networks {
+		for _, suffix := range suffixes {
+			versioned = append(versioned, n+suffix)
+		}
+	}
+	return versioned, nil
 }
 
 func main() {
 	var port = flag.Int("p", 53, "Port to listen on (default: 53)")
+	var listenAddr = flag.String("addr", "", "Address to bind to (default: all interfaces)")
+	flag.DurationVar(&cacheTTL, "cache-ttl", defaultCacheTTL, "How long to cache LLM responses, 0 disables caching (default: 1h)")
+	var cacheBackend = flag.String("cache-backend", cacheBackendMemory, "Where to cache responses: memory, or redis to share the cache between replicas (default: memory)")
+	var redisURL = flag.String("redis-url", defaultRedisURL, "Redis to use with -cache-backend redis (default: redis://localhost:6379/0)")
+	flag.BoolVar(&distributedLock, "distributed-lock", false, "With -cache-backend redis, lock each generation so only one replica calls the LLM for a query (default: false)")
+	var cacheMaxEntries = flag.Int("cache-max-entries", defaultCacheMaxEntries, "Maximum number of cached responses, 0 means unlimited (default: 10000)")
+	var cachePurgeInterval = flag.Duration("cache-purge-interval", defaultCachePurgeInterval, "How often to remove expired cache entries, 0 disables purging (default: 5m)")
+	var compressCache = flag.Bool("compress-cache", false, "Gzip long responses in the memory cache, using more CPU to hold more answers in less memory (default: false)")
+	flag.IntVar(&cacheJitter, "cache-jitter", 0, "Percentage to randomly lengthen or shorten each cache TTL by, spreading out expiries (default: 0)")
+	flag.BoolVar(&serveStale, "serve-stale", false, "Answer with expired cache entries while refreshing them in the background (default: false)")
+	flag.DurationVar(&maxStale, "max-stale", defaultMaxStale, "How long after expiry -serve-stale can still answer with an entry (default: 24h)")
+	var cacheFile = flag.String("cache-file", "", "File to load the cache from on startup and save it to on shutdown (default: no persistence)")
+	var providerName = flag.String("provider", "openai", "LLM provider to use: openai, anthropic, or stub (default: openai)")
+	var stub = flag.Bool("stub", false, "Answer with a deterministic stub instead of calling an LLM, same as -provider stub (default: false)")
+	flag.DurationVar(&llmTimeout, "llm-timeout", defaultLLMTimeout, "Maximum time to wait for the LLM to respond (default: 10s)")
+	var llmTotalTimeout = flag.Duration("llm-total-timeout", 0, "Total time budget for a generation including retries, overriding -llm-timeout when set (default: -llm-timeout)")
+	flag.DurationVar(&llmAttemptTimeout, "llm-attempt-timeout", 0, "Maximum time for each LLM attempt, so a hung attempt leaves budget to retry, 0 means the whole remaining budget (default: 0)")
+	flag.IntVar(&llmBreaker.threshold, "breaker-threshold", 0, "Consecutive LLM failures after which calls stop for -breaker-cooldown, 0 disables the circuit breaker (default: 0)")
+	flag.DurationVar(&llmBreaker.cooldown, "breaker-cooldown", defaultBreakerCooldown, "How long the circuit breaker stays open before a trial call tests recovery (default: 30s)")
+	flag.IntVar(&llmRetries, "llm-retries", defaultLLMRetries, "How many times to retry rate limited, server, or network errors from the LLM (default: 2)")
+	flag.StringVar(&zone, "zone", "", "Zone to answer for, e.g. chat.example.com, stripped from query names with other names getting NXDOMAIN (default: none)")
+	flag.BoolVar(&stripTrailingDot, "strip-trailing-dot", true, "Leave the trailing dot of query names out of prompts and logs (default: true)")
+	flag.BoolVar(&lowercaseNames, "lowercase-names", true, "Lowercase query names in prompts and logs, so case variants share a cache entry (default: true)")
+	flag.BoolVar(&nfcNames, "nfc-names", true, "Put query names in Unicode NFC form in prompts and logs, so composed and decomposed accents share a cache entry (default: true)")
+	flag.StringVar(&queryEncoding, "encoding", encodingNone, "How prompts are encoded in query labels: none, base32, or hex (default: none)")
+	var rate = flag.Float64("rate", 0, "Queries per second allowed per client IP, 0 disables rate limiting (default: 0)")
+	var burst = flag.Int("burst", defaultRateBurst, "Queries a client can burst above -rate (default: 5)")
+	flag.StringVar(&rateLimitMessage, "rate-limit-message", "", "TXT answer for rate limited TXT queries, with a retry-after hint, instead of REFUSED (default: none)")
+	var llmConcurrency = flag.Int("llm-concurrency", defaultLLMConcurrency, "Maximum concurrent LLM requests, 0 means unlimited (default: 8)")
+	var metricsAddr = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9090 (default: disabled)")
+	var logLevel = flag.String("log-level", "info", "Minimum log level: debug, info, warn, or error (default: info)")
+	var logFormat = flag.String("log-format", "text", "Log output format: text or json (default: text)")
+	flag.DurationVar(&answerTTL, "answer-ttl", 0, "TTL to put on TXT answers, 0 uses the remaining cache lifetime (default: 0)")
+	flag.DurationVar(&negativeTTL, "negative-ttl", defaultNegativeCacheTTL, "How long to cache LLM failures, 0 disables negative caching (default: 30s)")
+	var model = flag.String("model", "", "LLM model to use (default: gpt-5-nano for openai, claude-haiku-4-5 for anthropic)")
+	flag.Int64Var(&dailyBudget.limit, "daily-token-budget", 0, "Tokens the LLM may use per UTC day, after which queries are refused or get -fallback-answer, 0 means unlimited (default: 0)")
+	var apiKeyFile = flag.String("api-key-file", "", "File to read the provider's API key from, taking precedence over the environment variable (default: none)")
+	var maxTokens = flag.Int("max-tokens", 0, "Maximum tokens the LLM may generate per answer, bounding cost, 0 means the provider's default (default: 0)")
+	var temperature = flag.Float64("temperature", -1, "Sampling temperature between 0 and 2, lower is more deterministic, -1 means the provider's default (default: -1)")
+	var promptFile = flag.String("prompt-file", "", "File containing the system prompt template, with {{query}} where the query goes, reloaded on SIGHUP (default: built-in prompt)")
+	var selfCheck = flag.Bool("check", false, "Check the provider configuration, make a test LLM call, and bind the port, then exit without serving (default: false)")
+	var readyLLMCheck = flag.Bool("ready-llm-check", false, "Only report ready on /readyz after a test LLM call succeeds (default: false)")
+	flag.IntVar(&maxUDPSize, "max-udp-size", defaultMaxUDPSize, "Largest EDNS0 UDP message size to send, larger answers are truncated (default: 1232)")
+	flag.Float64Var(&maxUDPAmplification, "max-udp-amplification", 0, "Truncate UDP answers to queries without EDNS more than this many times the query size, so clients retry over TCP, 0 disables the limit (default: 0)")
+	flag.BoolVar(&multiRR, "multi-rr", false, "Split long answers across multiple TXT records of up to 4 strings each (default: false)")
+	flag.IntVar(&maxStringsPerRR, "max-strings-per-rr", defaultMaxStringsPerRR, "Most 255 byte strings in each TXT record, longer answers spill into more records, 0 means unlimited (default: 64)")
+	flag.DurationVar(&dedupTimeout, "dedup-timeout", defaultLLMTimeout, "How long duplicate queries wait on an identical in-flight generation (default: 10s)")
+	var nsList = flag.String("ns", "", "Comma separated name servers to answer NS queries for the zone apex with, requires -zone (default: none)")
+	var zskFile = flag.String("zsk-file", "", "Zone signing key from dnssec-keygen to sign answers with DNSSEC, as the path of its .key or .private file, requires -zone (default: no signing)")
+	var soaMName = flag.String("soa-mname", "", "Primary name server for the zone's SOA record, e.g. ns1.example.com, requires -zone (default: no SOA)")
+	var soaRName = flag.String("soa-rname", "", "Contact email for the zone's SOA record, e.g. hostmaster@example.com (default: hostmaster in the zone)")
+	var soaSerial = flag.Uint("soa-serial", 1, "Serial of the zone's SOA record (default: 1)")
+	var soaRefresh = flag.Uint("soa-refresh", defaultSOARefresh, "Refresh interval in seconds of the zone's SOA record (default: 3600)")
+	var soaRetry = flag.Uint("soa-retry", defaultSOARetry, "Retry interval in seconds of the zone's SOA record (default: 600)")
+	var soaExpire = flag.Uint("soa-expire", defaultSOAExpire, "Expire time in seconds of the zone's SOA record (default: 86400)")
+	var soaMinTTL = flag.Uint("soa-minttl", defaultSOAMinTTL, "Negative caching TTL in seconds of the zone's SOA record (default: 300)")
+	var aRecordFlag = flag.String("a-record", "", "IPv4 address to answer A queries for the zone apex with (default: none)")
+	var aaaaRecordFlag = flag.String("aaaa-record", "", "IPv6 address to answer AAAA queries for the zone apex with (default: none)")
+	var cnameFile = flag.String("cname-file", "", "JSON file mapping prompts like help to the canonical names to CNAME them to, reloaded on SIGHUP (default: none)")
+	flag.IntVar(&maxPromptLen, "max-prompt-len", 0, "Maximum characters in a decoded prompt, longer queries are refused, 0 means unlimited (default: 0)")
+	var allow = flag.String("allow", "", "Comma separated CIDRs allowed to query the server (default: all)")
+	var allowFile = flag.String("allow-file", "", "File of CIDRs, one per line, allowed to query the server instead of -allow, reloaded on SIGHUP (default: none)")
+	var deny = flag.String("deny", "", "Comma separated CIDRs refused even if allowed (default: none)")
+	var openAIBaseURL = flag.String("openai-base-url", defaultOpenAIBaseURL, "OpenAI API base URL, for proxies and Azure OpenAI (default: https://api.openai.com/v1)")
+	flag.StringVar(&userAgent, "user-agent", defaultUserAgent, "User-Agent for LLM API requests (default: DNSChat and the project URL)")
+	var secondarySpecs providerSpecsFlag
+	flag.Var(&secondarySpecs, "secondary-provider", "Provider to fall back to when the primary fails, as provider[:model][@openai-base-url], can be repeated to try several in order (default: none)")
+	flag.Var(extraHeaders, "llm-header", "Extra header for LLM API requests as \"Name: value\", can be repeated (default: none)")
+	var traceEnabled = flag.Bool("trace", false, "Export OpenTelemetry traces over OTLP, configured with the standard OTEL_* environment variables (default: false)")
+	flag.BoolVar(&paging, "paging", false, "Treat the first label as a cursor selecting one 255 byte chunk of the answer, e.g. 0.what.is.go (default: false)")
+	flag.BoolVar(&sessionsEnabled, "sessions", false, "Treat the first label (after any paging cursor) as a session ID, so follow up questions see the conversation so far (default: false)")
+	flag.IntVar(&sessionTurns, "session-turns", defaultSessionTurns, "How many previous turns of a session to include in the prompt (default: 5)")
+	flag.DurationVar(&sessionTTL, "session-ttl", defaultSessionTTL, "How long an unused session is kept (default: 30m)")
+	flag.BoolVar(&noCoalesce, "no-coalesce", false, "Generate separately for concurrent identical queries instead of sharing one generation (default: false)")
+	flag.BoolVar(&asyncAnswers, "async", false, "Answer uncached queries with status=pending straight away and generate in the background, for clients that poll (default: false)")
+	flag.StringVar(&answerEncoding, "answer-encoding", answerEncodingRaw, "How answers are written in TXT records: raw, or base64 to carry the LLM's text unsanitized (default: raw)")
+	flag.StringVar(&answerPrefix, "answer-prefix", "", "Text to put before every answer, e.g. >>> (default: none)")
+	flag.StringVar(&answerSuffix, "answer-suffix", "", "Text to put after every answer, e.g. <<< (default: none)")
+	var answerHMACKeyFlag = flag.String("answer-hmac-key", "", "Secret to sign answers with, appending an HMAC-SHA256 TXT string clients with the secret can verify (default: no signing)")
+	flag.BoolVar(&appendRequestID, "answer-request-id", false, "Append the request ID from the logs to answers as an extra TXT string (default: false)")
+	flag.IntVar(&minAnswerLen, "min-answer", 0, "Minimum answer length in bytes, shorter generations are treated as failures (default: 0)")
+	flag.IntVar(&maxAnswerLen, "max-answer", 0, "Maximum answer length in bytes, longer generations are truncated, 0 means unlimited (default: 0)")
+	var preloadFile = flag.String("preload-file", "", "File of prompts, one per line, to generate answers for at startup so they're cached (default: none)")
+	flag.StringVar(&nondataResponse, "nondata-response", nondataNotImpl, "Reply to unsupported query types with notimpl, or nodata for an empty NOERROR answer (default: notimpl)")
+	flag.BoolVar(&logTokenUsage, "log-token-usage", false, "Log the input and output tokens of every LLM call with its request ID, for cost analysis (default: false)")
+	flag.BoolVar(&redactPrompts, "redact-prompts", true, "Log a hash of each question instead of the question itself, except at debug level (default: true)")
+	flag.StringVar(&fallbackAnswer, "fallback-answer", "", "Answer to return when the LLM fails after retries, instead of SERVFAIL (default: none)")
+	flag.BoolVar(&askEnabled, "http-ask", false, "Answer GET /ask?q=... with JSON on the -metrics-addr server, sharing the DNS cache (default: false)")
+	flag.BoolVar(&debugAnswer, "debug-answer", false, "Append cache=hit or cache=miss to answers as an extra TXT string (default: false)")
+	flag.StringVar(&includeTimestamp, "include-timestamp", "", "Append when the answer was generated to answers as an extra TXT string, as rfc3339 or unix seconds (default: none)")
+	flag.IntVar(&maxInflightQueries, "max-inflight-queries", 0, "Maximum DNS queries handled at once, more are refused, 0 means unlimited (default: 0)")
+	flag.IntVar(&llmCandidates, "candidates", 1, "How many answers to generate per query, each returned as its own TXT record (default: 1)")
+	flag.StringVar(&aboutText, "about", "", "Text for the TXT record at the zone apex and _about label (default: DNSChat and the model name)")
+	var knowledgeFile = flag.String("knowledge-file", "", "JSON file mapping prompts to curated answers served without calling the LLM, reloaded on SIGHUP (default: none)")
+	var blocklistFile = flag.String("blocklist-file", "", "File of substrings, or regular expressions prefixed with re:, that prompts are refused for, reloaded on SIGHUP (default: none)")
+	flag.BoolVar(&statsQueryEnabled, "enable-stats-query", false, "Answer TXT queries for _stats under the zone with cache statistics (default: false)")
+	var statsAllow = flag.String("stats-allow", "127.0.0.1,::1", "Comma separated CIDRs allowed to query _stats (default: 127.0.0.1,::1)")
+	flag.BoolVar(&canonicalOwner, "canonical-owner", false, "Answer with the lowercased query name instead of echoing its case, breaking DNS 0x20 (default: false)")
+	var network = flag.String("net", "both", "Network to listen on: udp, tcp, or both (default: both)")
+	var ipVersion = flag.String("ip-version", "any", "IP version to listen on: 4, 6, both for separate IPv4 and IPv6 listeners, or any for the OS default (default: any)")
 	flag.Parse()
 
-	logger.Info("Starting DNS server", "port", *port)
+	var err error
+	logger, err = newLogger(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
 
-	err := dns.ListenAndServe(fmt.Sprintf(":%d", *port), "udp", &dnsHandler{})
+	var networks []string
+	switch *network {
+	case "udp", "tcp":
+		networks = []string{*network}
+	case "both":
+		networks = []string{"udp", "tcp"}
+	default:
+		log.Fatalf("Invalid -net value %q: must be udp, tcp, or both", *network)
+	}
+	networks, err = withIPVersion(networks, *ipVersion, *listenAddr)
 	if err != nil {
-		log.Fatalf("Failed to start DNS server: %v", err)
+		log.Fatalf("Invalid -ip-version %q: %v", *ipVersion, err)
+	}
+
+	if *port < 0 || *port > 65535 {
+		log.Fatalf("Invalid port %d: must be between 0 and 65535", *port)
+	}
+	addr := net.JoinHostPort(*listenAddr, strconv.Itoa(*port))
+	if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+		log.Fatalf("Invalid listen address %q: %v", addr, err)
+	}
+	if llmBreaker.threshold < 0 {
+		log.Fatalf("Invalid -breaker-threshold %d: must not be negative", llmBreaker.threshold)
+	}
+	if llmRetries < 0 {
+		log.Fatalf("Invalid -llm-retries %d: must not be negative", llmRetries)
+	}
+	if *llmTotalTimeout < 0 || llmAttemptTimeout < 0 {
+		log.Fatalf("Invalid LLM timeouts -llm-total-timeout %s -llm-attempt-timeout %s: must not be negative", *llmTotalTimeout, llmAttemptTimeout)
+	}
+	if *llmTotalTimeout > 0 {
+		llmTimeout = *llmTotalTimeout
+	}
+
+	if zone != "" {
+		zone = dns.Fqdn(zone)
+	}
+	if *nsList != "" {
+		if zone == "" {
+			log.Fatalf("-ns requires -zone")
+		}
+		if nsNames, err = parseNSList(*nsList); err != nil {
+			log.Fatalf("Invalid -ns list %q: %v", *nsList, err)
+		}
+	}
+	if *soaMName != "" {
+		if zone == "" {
+			log.Fatalf("-soa-mname requires -zone")
+		}
+		rname := cmp.Or(*soaRName, "hostmaster."+zone)
+		for _, v := range []uint{*soaSerial, *soaRefresh, *soaRetry, *soaExpire, *soaMinTTL} {
+			if v > math.MaxUint32 {
+				log.Fatalf("Invalid SOA value %d: must fit in 32 bits", v)
+			}
+		}
+		soaRecord, err = newSOARecord(zone, *soaMName, rname, uint32(*soaSerial), uint32(*soaRefresh), uint32(*soaRetry), uint32(*soaExpire), uint32(*soaMinTTL))
+		if err != nil {
+			log.Fatalf("Invalid SOA record: %v", err)
+		}
+	}
+	if *zskFile != "" {
+		if zone == "" {
+			log.Fatalf("-zsk-file requires -zone")
+		}
+		zoneKey, zoneSigner, err = loadZoneKey(*zskFile)
+		if err != nil {
+			log.Fatalf("Failed to load zone signing key %q: %v", *zskFile, err)
+		}
+		if !strings.EqualFold(zoneKey.Hdr.Name, zone) {
+			log.Fatalf("Zone signing key is for %s, not -zone %s", zoneKey.Hdr.Name, zone)
+		}
+		logger.Info("Signing answers with DNSSEC", "key_tag", zoneKey.KeyTag(), "algorithm", dns.AlgorithmToString[zoneKey.Algorithm])
+	}
+	if *aRecordFlag != "" {
+		if aRecord = net.ParseIP(*aRecordFlag).To4(); aRecord == nil {
+			log.Fatalf("Invalid -a-record %q: must be an IPv4 address", *aRecordFlag)
+		}
+	}
+	if *aaaaRecordFlag != "" {
+		if aaaaRecord = net.ParseIP(*aaaaRecordFlag); aaaaRecord == nil || aaaaRecord.To4() != nil {
+			log.Fatalf("Invalid -aaaa-record %q: must be an IPv6 address", *aaaaRecordFlag)
+		}
+	}
+	if *cnameFile != "" {
+		targets, err := loadCNAMEFile(*cnameFile)
+		if err != nil {
+			log.Fatalf("Failed to load CNAME file %q: %v", *cnameFile, err)
+		}
+		cnameTargets.Store(&targets)
+		logger.Info("Loaded CNAME file", "file", *cnameFile, "entries", len(targets))
+	}
+	if statsAllowNets, err = parseCIDRList(*statsAllow); err != nil {
+		log.Fatalf("Invalid -stats-allow list %q: %v", *statsAllow, err)
+	}
+	if *knowledgeFile != "" {
+		answers, err := loadKnowledgeFile(*knowledgeFile)
+		if err != nil {
+			log.Fatalf("Failed to load knowledge file %q: %v", *knowledgeFile, err)
+		}
+		knowledgeBase.Store(&answers)
+		logger.Info("Loaded knowledge file", "file", *knowledgeFile, "answers", len(answers))
+	}
+	if *blocklistFile != "" {
+		b, err := loadBlocklistFile(*blocklistFile)
+		if err != nil {
+			log.Fatalf("Failed to load blocklist file %q: %v", *blocklistFile, err)
+		}
+		promptBlocklist.Store(b)
+		logger.Info("Loaded blocklist file", "file", *blocklistFile, "patterns", b.len())
+	}
+	if *allow != "" && *allowFile != "" {
+		log.Fatalf("-allow can't be combined with -allow-file, put every allowed network in the file")
+	}
+	if *allowFile != "" {
+		nets, err := loadAllowFile(*allowFile)
+		if err != nil {
+			log.Fatalf("Failed to load allow file %q: %v", *allowFile, err)
+		}
+		allowNets.Store(&nets)
+		logger.Info("Loaded allow file", "file", *allowFile, "networks", len(nets))
+	} else {
+		nets, err := parseCIDRList(*allow)
+		if err != nil {
+			log.Fatalf("Invalid -allow list %q: %v", *allow, err)
+		}
+		allowNets.Store(&nets)
+	}
+	if denyNets, err = parseCIDRList(*deny); err != nil {
+		log.Fatalf("Invalid -deny list %q: %v", *deny, err)
+	}
+	switch queryEncoding {
+	case encodingNone, encodingBase32, encodingHex:
+	default:
+		log.Fatalf("Invalid -encoding value %q: must be none, base32, or hex", queryEncoding)
+	}
+	switch nondataResponse {
+	case nondataNotImpl, nondataNoData:
+	default:
+		log.Fatalf("Invalid -nondata-response value %q: must be notimpl or nodata", nondataResponse)
+	}
+
+	if maxUDPSize < dns.MinMsgSize || maxUDPSize > dns.MaxMsgSize {
+		log.Fatalf("Invalid -max-udp-size %d: must be between %d and %d", maxUDPSize, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	if maxUDPAmplification < 0 {
+		log.Fatalf("Invalid -max-udp-amplification %g: must not be negative", maxUDPAmplification)
+	}
+	if cacheJitter < 0 || cacheJitter > 100 {
+		log.Fatalf("Invalid -cache-jitter %d: must be between 0 and 100", cacheJitter)
+	}
+	if minAnswerLen < 0 || maxAnswerLen < 0 || (maxAnswerLen > 0 && minAnswerLen > maxAnswerLen) {
+		log.Fatalf("Invalid answer bounds -min-answer %d -max-answer %d", minAnswerLen, maxAnswerLen)
+	}
+	if maxStringsPerRR < 0 {
+		log.Fatalf("Invalid -max-strings-per-rr %d: must not be negative", maxStringsPerRR)
+	}
+	if llmCandidates < 1 {
+		log.Fatalf("Invalid -candidates %d: must be at least 1", llmCandidates)
+	}
+	if llmCandidates > 1 && (paging || multiRR) {
+		log.Fatalf("-candidates above 1 can't be combined with -paging or -multi-rr, as both split one answer across records")
+	}
+	switch includeTimestamp {
+	case "", timestampRFC3339, timestampUnix:
+	default:
+		log.Fatalf("Invalid -include-timestamp value %q: must be rfc3339 or unix", includeTimestamp)
+	}
+	switch answerEncoding {
+	case answerEncodingRaw:
+	case answerEncodingBase64:
+		// Unsanitized candidates could contain the separator they're joined with
+		if llmCandidates > 1 {
+			log.Fatalf("-answer-encoding base64 can't be combined with -candidates above 1")
+		}
+	default:
+		log.Fatalf("Invalid -answer-encoding value %q: must be raw or base64", answerEncoding)
+	}
+	if *answerHMACKeyFlag != "" {
+		answerHMACKey = []byte(*answerHMACKeyFlag)
+	}
+	if askEnabled && *metricsAddr == "" {
+		log.Fatalf("-http-ask requires -metrics-addr")
+	}
+	if asyncAnswers && cacheTTL <= 0 {
+		log.Fatalf("-async requires caching, as answers generated in the background are only returned from the cache")
+	}
+	if *llmConcurrency > 0 {
+		llmSemaphore = make(chan struct{}, *llmConcurrency)
+	}
+	httpClient = newHTTPClient(llmTimeout, *llmConcurrency)
+
+	if *promptFile != "" {
+		prompt, err := loadSystemPrompt(*promptFile)
+		if err != nil {
+			log.Fatalf("Failed to read prompt file %q: %v", *promptFile, err)
+		}
+		systemPrompt.Store(&prompt)
+		logger.Info("Loaded system prompt", "file", *promptFile)
+	}
+
+	if *stub {
+		*providerName = "stub"
+	}
+	if dailyBudget.limit < 0 {
+		log.Fatalf("Invalid -daily-token-budget %d: must not be negative", dailyBudget.limit)
+	}
+	if *maxTokens < 0 {
+		log.Fatalf("Invalid -max-tokens %d: must not be negative", *maxTokens)
+	}
+	opts := providerOptions{
+		model:         *model,
+		openAIBaseURL: *openAIBaseURL,
+		maxTokens:     *maxTokens,
+	}
+	if *apiKeyFile != "" {
+		if opts.apiKey, err = loadAPIKey(*apiKeyFile); err != nil {
+			log.Fatalf("Failed to read API key file %q: %v", *apiKeyFile, err)
+		}
+	}
+	if *temperature != -1 {
+		if *temperature < 0 || *temperature > 2 {
+			log.Fatalf("Invalid -temperature %g: must be between 0 and 2", *temperature)
+		}
+		opts.temperature = temperature
+	}
+	provider, err = newLLMProvider(*providerName, opts)
+	if err != nil {
+		log.Fatalf("Failed to create LLM provider: %v", err)
+	}
+	// Without an API key every generation would fail, so refuse to start rather than serve SERVFAILs.
+	// -check reports it, and the same for each secondary, along with its other checks instead.
+	if c, ok := provider.(configChecker); ok && !*selfCheck {
+		if err := c.CheckConfig(); err != nil {
+			log.Fatalf("Invalid %s provider configuration: %v, or use -api-key-file", *providerName, err)
+		}
+	}
+	logger.Info("Using LLM provider", "provider", *providerName, "model", provider.Model())
+	for _, spec := range secondarySpecs {
+		p, err := newSecondaryProvider(spec, opts)
+		if err != nil {
+			log.Fatalf("Invalid -secondary-provider %q: %v", spec, err)
+		}
+		if c, ok := p.(configChecker); ok && !*selfCheck {
+			if err := c.CheckConfig(); err != nil {
+				log.Fatalf("Invalid -secondary-provider %q configuration: %v", spec, err)
+			}
+		}
+		secondaryProviders = append(secondaryProviders, p)
+		logger.Info("Using secondary LLM provider", "spec", spec, "model", p.Model())
+	}
+
+	handler := &dnsHandler{}
+
+	// memCache is only set for the memory backend, which is the one that's persisted and purged here
+	var memCache *memoryCache
+	closeCache := func() error { return nil }
+	switch *cacheBackend {
+	case cacheBackendMemory:
+		memCache = newMemoryCache(*cacheMaxEntries)
+		memCache.compress = *compressCache
+		responseCache = memCache
+	case cacheBackendRedis:
+		if *compressCache {
+			log.Fatalf("-compress-cache only works with -cache-backend memory")
+		}
+		if *cacheFile != "" {
+			log.Fatalf("-cache-file only works with -cache-backend memory, Redis persists the cache itself")
+		}
+		rc, err := newRedisCache(context.Background(), *redisURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to Redis: %v", err)
+		}
+		responseCache, closeCache = rc, rc.Close
+		logger.Info("Using Redis cache")
+	default:
+		log.Fatalf("Invalid -cache-backend value %q: must be memory or redis", *cacheBackend)
+	}
+	if _, ok := responseCache.(cacheLocker); distributedLock && !ok {
+		log.Fatalf("-distributed-lock requires a shared -cache-backend like redis")
+	}
+
+	if *cacheFile != "" {
+		loaded, err := memCache.load(*cacheFile)
+		if err != nil {
+			log.Fatalf("Failed to load cache from %q: %v", *cacheFile, err)
+		}
+		logger.Info("Loaded cache", "file", *cacheFile, "entries", loaded)
+	}
+
+	if *selfCheck {
+		ok := runSelfCheck(context.Background(), os.Stdout, addr, networks)
+		closeCache()
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdownTracing := func(context.Context) error { return nil }
+	if *traceEnabled {
+		shutdownTracing, err = setupTracing(ctx)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
+		logger.Info("Exporting traces over OTLP")
+	}
+	var wg sync.WaitGroup
+	if rateLimitMessage != "" && *rate <= 0 {
+		log.Fatalf("-rate-limit-message requires -rate")
+	}
+	if *rate > 0 {
+		if *burst < 1 {
+			log.Fatalf("Invalid -burst %d: must be at least 1", *burst)
+		}
+		limiter = newRateLimiter(*rate, *burst)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.runCleanup(ctx, rateLimitCleanupInterval)
+		}()
+	}
+	if sessionsEnabled {
+		if sessionTurns < 1 {
+			log.Fatalf("Invalid -session-turns %d: must be at least 1", sessionTurns)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSessionPurger(ctx, sessionPurgeInterval)
+		}()
+	}
+	if *readyLLMCheck {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runReadyLLMCheck(ctx)
+		}()
+	} else {
+		llmCheckPassed.Store(true)
+	}
+	if *metricsAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runHTTPServer(ctx, *metricsAddr, newMetricsMux())
+		}()
+	}
+	if memCache != nil && *cachePurgeInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCachePurger(ctx, memCache, *cachePurgeInterval)
+		}()
+	}
+
+	if *preloadFile != "" {
+		prompts, err := loadPreloadFile(*preloadFile)
+		if err != nil {
+			log.Fatalf("Failed to read preload file %q: %v", *preloadFile, err)
+		}
+		workers := *llmConcurrency
+		if workers <= 0 {
+			workers = defaultLLMConcurrency
+		}
+		start := time.Now()
+		succeeded := preloadCache(ctx, prompts, workers)
+		logger.Info("Preloaded cache", "file", *preloadFile, "prompts", len(prompts), "succeeded", succeeded, "duration", time.Since(start))
+	}
+
+	// Run each listener in its own goroutine, a failure in any of them shuts down the process
+	servers := make([]*dns.Server, 0, len(networks))
+	errCh := make(chan error, len(networks))
+	listenersPending.Store(int32(len(networks)))
+	for _, n := range networks {
+		server := &dns.Server{
+			Addr:              addr,
+			Net:               n,
+			Handler:           handler,
+			NotifyStartedFunc: func() { listenersPending.Add(-1) },
+		}
+		servers = append(servers, server)
+		logger.Info("Starting DNS server", "addr", addr, "net", n)
+		go func() {
+			errCh <- server.ListenAndServe()
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	// SIGHUP reloads the file-based configuration without dropping the listeners or the cache
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	files := reloadableFiles{prompt: *promptFile, blocklist: *blocklistFile, cname: *cnameFile, knowledge: *knowledgeFile, allow: *allowFile}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupCh:
+				logger.Info("Reloading configuration files")
+				reloadConfig(files)
+			}
+		}
+	}()
+
+	exitCode := 0
+	select {
+	case sig := <-sigCh:
+		logger.Info("Shutting down", "signal", sig.String())
+	case err := <-errCh:
+		logger.Error("DNS server failed", "error", err)
+		exitCode = 1
+	}
+
+	// Give in-flight queries up to the LLM timeout to finish
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), llmTimeout)
+	for _, server := range servers {
+		if err := server.ShutdownContext(shutdownCtx); err != nil {
+			logger.Error("Failed to shut down DNS server", "net", server.Net, "error", err)
+			exitCode = 1
+		}
+	}
+	shutdownCancel()
+
+	// Stop background work before exiting
+	cancel()
+	wg.Wait()
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Error("Failed to flush traces", "error", err)
+	}
+	if *cacheFile != "" {
+		saved, err := memCache.save(*cacheFile)
+		if err != nil {
+			logger.Error("Failed to save cache", "file", *cacheFile, "error", err)
+			exitCode = 1
+		} else {
+			logger.Info("Saved cache", "file", *cacheFile, "entries", saved)
+		}
+	}
+	if err := closeCache(); err != nil {
+		logger.Error("Failed to close cache", "error", err)
 	}
+	os.Exit(exitCode)
 }
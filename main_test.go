@@ -0,0 +1,1151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMain(m *testing.M) {
+	// Tests fail generations on purpose, logging them would bury the test output
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// setForTest sets *p to v until the test finishes, then restores its old value
+func setForTest[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// useFreshCache gives the test an empty memory cache of its own
+func useFreshCache(t *testing.T) *memoryCache {
+	t.Helper()
+	c := newMemoryCache(defaultCacheMaxEntries)
+	setForTest(t, &responseCache, Cache(c))
+	return c
+}
+
+// stubGenerate replaces generateResponse with fn for the test, returning a count of its calls
+func stubGenerate(t *testing.T, fn func(ctx context.Context, q string) ([]string, error)) *atomic.Int64 {
+	t.Helper()
+	var calls atomic.Int64
+	setForTest(t, &generateResponse, func(ctx context.Context, q string) ([]string, error) {
+		calls.Add(1)
+		return fn(ctx, q)
+	})
+	return &calls
+}
+
+// answerWith returns a generator always answering with answers, one per candidate
+func answerWith(answers ...string) func(context.Context, string) ([]string, error) {
+	return func(context.Context, string) ([]string, error) {
+		return answers, nil
+	}
+}
+
+// logBuffer collects log output, safe for the goroutines a query can log from
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the logs at level and above to the returned buffer until the test finishes
+func captureLogs(t *testing.T, level slog.Level) *logBuffer {
+	t.Helper()
+	b := &logBuffer{}
+	setForTest(t, &logger, slog.New(slog.NewTextHandler(b, &slog.HandlerOptions{Level: level})))
+	return b
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testWriter is a dns.ResponseWriter keeping the reply written to it
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+// testClientAddr is where test queries come from, a documentation address
+var testClientAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+
+// newQuery builds a query for name and qtype as a resolver would send it
+func newQuery(name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	return r
+}
+
+// exchangeFrom serves r as if it arrived from remote, returning the reply or nil if none was written
+func exchangeFrom(remote net.Addr, r *dns.Msg) *dns.Msg {
+	w := &testWriter{remote: remote}
+	(&dnsHandler{}).ServeDNS(w, r)
+	return w.msg
+}
+
+// exchange serves r as if it arrived over UDP from testClientAddr
+func exchange(t *testing.T, r *dns.Msg) *dns.Msg {
+	t.Helper()
+	m := exchangeFrom(testClientAddr, r)
+	if m == nil {
+		t.Fatalf("no reply to %s", r.Question[0].Name)
+	}
+	return m
+}
+
+// exchangeTCP serves r as if it arrived over TCP, where replies aren't truncated
+func exchangeTCP(t *testing.T, r *dns.Msg) *dns.Msg {
+	t.Helper()
+	m := exchangeFrom(&net.TCPAddr{IP: testClientAddr.IP, Port: testClientAddr.Port}, r)
+	if m == nil {
+		t.Fatalf("no reply to %s", r.Question[0].Name)
+	}
+	return m
+}
+
+// txtStrings returns every character-string of the TXT records in m's answer, in order
+func txtStrings(m *dns.Msg) []string {
+	var strs []string
+	for _, rr := range m.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			strs = append(strs, txt.Txt...)
+		}
+	}
+	return strs
+}
+
+func TestGetOrCreateLLMRequestDeduplicatesConcurrentQueries(t *testing.T) {
+	useFreshCache(t)
+	release := make(chan struct{})
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		<-release
+		return []string{"shared answer"}, nil
+	})
+
+	const queries = 10
+	dedupBefore := counterValue(inFlightDedupTotal)
+	results := make([]llmResult, queries)
+	errs := make([]error, queries)
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = getOrCreateLLMRequest(context.Background(), "what is dns", false)
+		}()
+	}
+	// Hold the generation until every other query is waiting on it
+	waitFor(t, "queries to join the in-flight generation", func() bool {
+		return counterValue(inFlightDedupTotal)-dedupBefore == queries-1
+	})
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generateResponse called %d times, want 1", got)
+	}
+	for i := range queries {
+		if errs[i] != nil {
+			t.Fatalf("query %d failed: %v", i, errs[i])
+		}
+		if !slices.Equal(results[i].answers, []string{"shared answer"}) {
+			t.Errorf("query %d got %q, want the shared answer", i, results[i].answers)
+		}
+	}
+
+	// Once it's finished the answer comes from the cache, without another generation
+	result, err := getOrCreateLLMRequest(context.Background(), "what is dns", false)
+	if err != nil || !result.cached {
+		t.Errorf("repeat query got cached=%v, err=%v, want a cache hit", result.cached, err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generateResponse called %d times after the repeat, want 1", got)
+	}
+}
+
+func TestTraceAttributesRedactQuestions(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("an answer"))
+	rec := tracetest.NewSpanRecorder()
+	setForTest(t, &tracer, trace.Tracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")))
+
+	exchange(t, newQuery("my.private.question", dns.TypeTXT))
+	spans := rec.Ended()
+	if len(spans) == 0 {
+		t.Fatal("no spans recorded")
+	}
+	for _, span := range spans {
+		for _, attr := range span.Attributes() {
+			if v := attr.Value.Emit(); strings.Contains(v, "private") {
+				t.Errorf("span %s attribute %s holds the question: %q", span.Name(), attr.Key, v)
+			}
+		}
+	}
+}
+
+func TestUDPAnswerOverBufferSizeIsTruncated(t *testing.T) {
+	useFreshCache(t)
+	answer := strings.TrimSpace(strings.Repeat("An answer too long for a small buffer. ", 20))
+	stubGenerate(t, answerWith(answer))
+
+	small := newQuery("tell.me.everything", dns.TypeTXT)
+	small.SetEdns0(512, false)
+	m := exchange(t, small)
+	if !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("got TC=%v with %d answers, want a truncated reply with none", m.Truncated, len(m.Answer))
+	}
+	if m.IsEdns0() == nil {
+		t.Error("truncated reply dropped the OPT record")
+	}
+
+	large := newQuery("tell.me.everything", dns.TypeTXT)
+	large.SetEdns0(4096, false)
+	if m := exchange(t, large); m.Truncated || strings.Join(txtStrings(m), "") != answer {
+		t.Errorf("4096 byte buffer got TC=%v, want the whole answer", m.Truncated)
+	}
+	if m := exchangeTCP(t, newQuery("tell.me.everything", dns.TypeTXT)); m.Truncated || strings.Join(txtStrings(m), "") != answer {
+		t.Errorf("TCP got TC=%v, want the whole answer", m.Truncated)
+	}
+}
+
+func TestAmplificationLimitTruncatesUDPWithoutEDNS(t *testing.T) {
+	useFreshCache(t)
+	answer := strings.Repeat("A long answer to a short question. ", 6)
+	stubGenerate(t, answerWith(strings.TrimSpace(answer)))
+	setForTest(t, &maxUDPAmplification, 2.0)
+
+	m := exchange(t, newQuery("why", dns.TypeTXT))
+	if !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("got TC=%v with %d answers, want a truncated reply over the ratio", m.Truncated, len(m.Answer))
+	}
+	if m := exchangeTCP(t, newQuery("why", dns.TypeTXT)); m.Truncated || len(m.Answer) == 0 {
+		t.Errorf("TCP got TC=%v with %d answers, want the whole answer", m.Truncated, len(m.Answer))
+	}
+
+	edns := newQuery("why", dns.TypeTXT)
+	edns.SetEdns0(4096, false)
+	if m := exchange(t, edns); m.Truncated || len(m.Answer) == 0 {
+		t.Errorf("EDNS got TC=%v with %d answers, want the ratio not to apply", m.Truncated, len(m.Answer))
+	}
+
+	setForTest(t, &maxUDPAmplification, 0.0)
+	if m := exchange(t, newQuery("why", dns.TypeTXT)); m.Truncated || len(m.Answer) == 0 {
+		t.Errorf("with no limit got TC=%v with %d answers, want the answer within 512 bytes", m.Truncated, len(m.Answer))
+	}
+}
+
+func TestDedupWaitersGiveUpOnSlowLeader(t *testing.T) {
+	useFreshCache(t)
+	release := make(chan struct{})
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		<-release
+		return []string{"late answer"}, nil
+	})
+	setForTest(t, &dedupTimeout, 50*time.Millisecond)
+
+	leader := make(chan error, 1)
+	go func() {
+		_, err := getOrCreateLLMRequest(context.Background(), "slow question", false)
+		leader <- err
+	}()
+	waitFor(t, "the leader to start generating", func() bool { return calls.Load() == 1 })
+
+	start := time.Now()
+	if _, err := getOrCreateLLMRequest(context.Background(), "slow question", false); !errors.Is(err, errDedupTimeout) {
+		t.Errorf("waiter got %v, want errDedupTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waiter gave up after %s, want about the 50ms timeout", elapsed)
+	}
+	if m := exchange(t, newQuery("slow.question", dns.TypeTXT)); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("waiting query got %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+
+	// The leader isn't affected, and its answer serves later queries
+	close(release)
+	if err := <-leader; err != nil {
+		t.Fatalf("leader failed: %v", err)
+	}
+	if got := txtStrings(exchange(t, newQuery("slow.question", dns.TypeTXT))); !slices.Equal(got, []string{"late answer"}) {
+		t.Errorf("got %q after the leader finished, want its answer", got)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want only the leader's", got)
+	}
+}
+
+func TestAnswerTTLFor(t *testing.T) {
+	in := func(d time.Duration) time.Time { return time.Now().Add(d) }
+	for _, tc := range []struct {
+		name      string
+		result    llmResult
+		answerTTL time.Duration
+		want      uint32
+	}{
+		{"remaining cache lifetime", llmResult{expiresAt: in(90*time.Second + 500*time.Millisecond)}, 0, 90},
+		{"expired", llmResult{expiresAt: in(-time.Second)}, 0, 0},
+		{"not cached", llmResult{}, 0, 0},
+		{"answer-ttl overrides", llmResult{expiresAt: in(time.Hour)}, 30 * time.Second, 30},
+		{"curated", llmResult{curated: true}, 0, staticTTL},
+		{"stale", llmResult{stale: true, expiresAt: in(-time.Minute)}, 10 * time.Second, uint32(staleAnswerTTL / time.Second)},
+		{"fallback", llmResult{fallback: true}, 30 * time.Second, 0},
+		{"pending", llmResult{pending: true, expiresAt: in(time.Hour)}, 0, 0},
+	} {
+		setForTest(t, &answerTTL, tc.answerTTL)
+		if got := answerTTLFor(tc.result); got != tc.want {
+			t.Errorf("%s: got TTL %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAnswerTTLCountsDownInCache(t *testing.T) {
+	c := useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &cacheTTL, time.Hour)
+
+	m := exchange(t, newQuery("how.long", dns.TypeTXT))
+	if ttl := m.Answer[0].Header().Ttl; ttl < 3598 || ttl > 3600 {
+		t.Errorf("fresh answer has TTL %d, want the hour it's cached for", ttl)
+	}
+
+	// Age the entry by half its lifetime
+	key := cacheKey("how long")
+	entry, ok := c.Get(key)
+	if !ok {
+		t.Fatal("answer wasn't cached")
+	}
+	entry.expiresAt = time.Now().Add(30 * time.Minute)
+	c.Set(entry, time.Hour)
+	m = exchange(t, newQuery("how.long", dns.TypeTXT))
+	if ttl := m.Answer[0].Header().Ttl; ttl < 1798 || ttl > 1800 {
+		t.Errorf("cached answer has TTL %d, want the half hour left", ttl)
+	}
+}
+
+// chunkLens returns the byte length of each chunk
+func chunkLens(chunks []string) []int {
+	lens := make([]int, len(chunks))
+	for i, c := range chunks {
+		lens[i] = len(c)
+	}
+	return lens
+}
+
+func TestChunkStringAtTXTLimit(t *testing.T) {
+	rune4 := "😀" // 4 bytes in UTF-8
+	for _, tc := range []struct {
+		name string
+		s    string
+		want []int
+	}{
+		{"255 bytes", strings.Repeat("a", 255), []int{255}},
+		{"256 bytes", strings.Repeat("a", 256), []int{255, 1}},
+		{"510 bytes", strings.Repeat("a", 510), []int{255, 255}},
+		{"4-byte rune ending at 255", strings.Repeat("a", 251) + rune4, []int{255}},
+		{"4-byte rune straddling 255", strings.Repeat("a", 253) + rune4 + "b", []int{253, 5}},
+		{"4-byte runes only", strings.Repeat(rune4, 64), []int{252, 4}},
+	} {
+		chunks := chunkString(tc.s, txtMaxStringLen)
+		if got := chunkLens(chunks); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got chunks of %v bytes, want %v", tc.name, got, tc.want)
+		}
+		if strings.Join(chunks, "") != tc.s {
+			t.Errorf("%s: chunks don't join back to the input", tc.name)
+		}
+		for i, c := range chunks {
+			if !utf8.ValidString(c) {
+				t.Errorf("%s: chunk %d splits a rune", tc.name, i)
+			}
+		}
+	}
+}
+
+func TestMultipleQuestionsGetFORMERR(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	r := newQuery("first.question", dns.TypeTXT)
+	r.Question = append(r.Question, dns.Question{Name: "second.question.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+
+	if m := exchange(t, r); m.Rcode != dns.RcodeFormatError || len(m.Answer) != 0 {
+		t.Errorf("two questions got %s with %d answers, want FORMERR", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for a rejected query", got)
+	}
+
+	r.Question = nil
+	if m := exchangeFrom(testClientAddr, r); m == nil || m.Rcode != dns.RcodeFormatError {
+		t.Errorf("no questions got %v, want FORMERR", m)
+	}
+}
+
+func TestCleanResponse(t *testing.T) {
+	for in, want := range map[string]string{
+		"Go is great! 😀🚀":                  "Go is great",
+		"Line one.\nLine two.\r\n":         "Line one. Line two.",
+		"Tabs\tbetween\t\twords":           "Tabs between words",
+		"Café, naïve, Ωmega?":              "Caf, nave, mega?",
+		"日本語 answer":                       "answer",
+		"Control\x00chars\x07here\x1b[0m.": "Controlcharshere0m.",
+		"  Already, clean?  ":              "Already, clean?",
+		"😀":                                "",
+	} {
+		if got := cleanResponse(in); got != want {
+			t.Errorf("cleanResponse(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestExtendedErrorFor(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code uint16
+		text string
+	}{
+		{errNegativeCached, dns.ExtendedErrorCodeCachedError, "upstream recently failed"},
+		{ErrEmptyAnswer, dns.ExtendedErrorCodeInvalidData, "upstream returned an empty answer"},
+		{fmt.Errorf("%w: bad json", ErrBadResponse), dns.ExtendedErrorCodeInvalidData, "upstream returned an unreadable response"},
+		{errBudgetExhausted, dns.ExtendedErrorCodeProhibited, "daily token budget exhausted"},
+		{errCircuitOpen, dns.ExtendedErrorCodeNotReady, "upstream failing, not calling it for now"},
+		{errAnswerTooShort, dns.ExtendedErrorCodeInvalidData, "upstream answer too short"},
+		{fmt.Errorf("%w: %w", ErrUpstreamUnavailable, context.DeadlineExceeded), dns.ExtendedErrorCodeNoReachableAuthority, "upstream timed out"},
+		{errDedupTimeout, dns.ExtendedErrorCodeNoReachableAuthority, "upstream timed out"},
+		{&statusError{StatusCode: http.StatusTooManyRequests}, dns.ExtendedErrorCodeOther, "upstream rate limited"},
+		{&statusError{StatusCode: http.StatusUnauthorized}, dns.ExtendedErrorCodeOther, "upstream returned status 401"},
+		{fmt.Errorf("%w: %w", ErrUpstreamUnavailable, &url.Error{Op: "Post", Err: errors.New("connection refused")}), dns.ExtendedErrorCodeNetworkError, "upstream unreachable"},
+		{ErrUpstreamUnavailable, dns.ExtendedErrorCodeNoReachableAuthority, "upstream unavailable"},
+		{errors.New("something else"), dns.ExtendedErrorCodeOther, "could not generate answer"},
+	} {
+		code, text := extendedErrorFor(tc.err)
+		if code != tc.code || text != tc.text {
+			t.Errorf("%v: got %s %q, want %s %q", tc.err, dns.ExtendedErrorCodeToString[code], text, dns.ExtendedErrorCodeToString[tc.code], tc.text)
+		}
+	}
+}
+
+// extendedError returns the Extended DNS Error in m, nil if there isn't one
+func extendedError(m *dns.Msg) *dns.EDNS0_EDE {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				return ede
+			}
+		}
+	}
+	return nil
+}
+
+func TestFailedGenerationCarriesExtendedError(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, func(context.Context, string) ([]string, error) {
+		return nil, &statusError{StatusCode: http.StatusTooManyRequests}
+	})
+	setForTest(t, &fallbackAnswer, "")
+
+	r := newQuery("busy.question", dns.TypeTXT)
+	r.SetEdns0(1232, false)
+	m := exchange(t, r)
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("got %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	ede := extendedError(m)
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeOther || ede.ExtraText != "upstream rate limited" {
+		t.Errorf("got extended error %v, want Other with upstream rate limited", ede)
+	}
+
+	// Clients without EDNS have nowhere to put one
+	if m := exchange(t, newQuery("busy.question", dns.TypeTXT)); m.Rcode != dns.RcodeServerFailure || m.IsEdns0() != nil {
+		t.Errorf("non-EDNS query got %s with OPT %v, want SERVFAIL without", dns.RcodeToString[m.Rcode], m.IsEdns0())
+	}
+}
+
+func TestNewReplyEchoesEDNS(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		bufferSize uint16
+		edns       bool
+		want       int
+	}{
+		{"no EDNS", 0, false, 0},
+		{"1232 byte buffer", 1232, true, 1232},
+		{"below the minimum", 256, true, dns.MinMsgSize},
+		{"above the clamp", 65000, true, maxUDPSize},
+	} {
+		r := newQuery("hello", dns.TypeTXT)
+		if tc.edns {
+			r.SetEdns0(tc.bufferSize, true)
+		}
+		m := newReply(r)
+		opt := m.IsEdns0()
+		if !tc.edns {
+			if opt != nil {
+				t.Errorf("%s: reply has an OPT record", tc.name)
+			}
+			continue
+		}
+		if opt == nil {
+			t.Errorf("%s: reply has no OPT record", tc.name)
+			continue
+		}
+		if got := int(opt.UDPSize()); got != tc.want {
+			t.Errorf("%s: reply advertises %d bytes, want %d", tc.name, got, tc.want)
+		}
+		if opt.Do() {
+			t.Errorf("%s: reply sets the DO bit", tc.name)
+		}
+	}
+	useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	r := newQuery("hello", dns.TypeTXT)
+	r.SetEdns0(1232, false)
+	if opt := exchange(t, r).IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+		t.Errorf("answer to an EDNS query has OPT %v, want one advertising 1232 bytes", opt)
+	}
+}
+
+func TestMultiRRAnswerReassembles(t *testing.T) {
+	useFreshCache(t)
+	var words []string
+	for i := 0; len(strings.Join(words, " ")) < 2048; i++ {
+		words = append(words, fmt.Sprintf("word%d", i))
+	}
+	answer := strings.Join(words, " ")
+	stubGenerate(t, answerWith(answer))
+	setForTest(t, &multiRR, true)
+
+	m := exchangeTCP(t, newQuery("tell.me.a.long.story", dns.TypeTXT))
+	// Reassemble from the wire form, as a client would
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(dns.Msg)
+	if err := got.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+	if want := (len(answer) + txtMaxStringLen*multiRRStrings - 1) / (txtMaxStringLen * multiRRStrings); len(got.Answer) != want {
+		t.Errorf("got %d TXT records, want %d of at most %d strings", len(got.Answer), want, multiRRStrings)
+	}
+	for i, rr := range got.Answer {
+		if n := len(rr.(*dns.TXT).Txt); n > multiRRStrings {
+			t.Errorf("record %d holds %d strings, want at most %d", i, n, multiRRStrings)
+		}
+	}
+	if reassembled := strings.Join(txtStrings(got), ""); reassembled != answer {
+		t.Errorf("reassembled %d bytes that don't match the %d byte answer", len(reassembled), len(answer))
+	}
+}
+
+func TestMixedCaseQueriesShareOneGeneration(t *testing.T) {
+	useFreshCache(t)
+	release := make(chan struct{})
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		<-release
+		return []string{"Go is a programming language."}, nil
+	})
+
+	names := []string{"what.is.go", "What.Is.Go", "WHAT.IS.GO", "wHaT.iS.gO"}
+	dedupBefore := counterValue(inFlightDedupTotal)
+	replies := make([]*dns.Msg, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i] = exchangeFrom(testClientAddr, newQuery(name, dns.TypeTXT))
+		}()
+	}
+	waitFor(t, "the variants to join one generation", func() bool {
+		return counterValue(inFlightDedupTotal)-dedupBefore == float64(len(names)-1)
+	})
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want one generation for every case variant", got)
+	}
+	for i, m := range replies {
+		if got := txtStrings(m); !slices.Equal(got, []string{"Go is a programming language."}) {
+			t.Errorf("%s got %q, want the shared answer", names[i], got)
+		}
+	}
+	// Later variants are answered from the same cache entry
+	exchange(t, newQuery("WhAt.Is.Go", dns.TypeTXT))
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times after a cached variant, want 1", got)
+	}
+}
+
+func TestAnswerEchoesDNS0x20Case(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith(strings.Repeat("A long answer split over records. ", 40)))
+	setForTest(t, &multiRR, true)
+
+	// The second query is answered from the cache entry the first created
+	for _, name := range []string{"wHaT.iS.dNs.", "WhAt.Is.DnS."} {
+		m := exchangeTCP(t, newQuery(name, dns.TypeTXT))
+		if len(m.Answer) < 2 {
+			t.Fatalf("%s: got %d records, want the answer split over several", name, len(m.Answer))
+		}
+		if m.Question[0].Name != name {
+			t.Errorf("%s: question echoed as %s", name, m.Question[0].Name)
+		}
+		for i, rr := range m.Answer {
+			if got := rr.Header().Name; got != name {
+				t.Errorf("%s: record %d has owner %s, want the query's exact case", name, i, got)
+			}
+		}
+	}
+}
+
+func TestOverLengthPromptIsRefused(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &maxPromptLen, 10)
+
+	m := exchange(t, newQuery("a.question.far.too.long", dns.TypeTXT))
+	if m.Rcode != dns.RcodeRefused {
+		t.Errorf("over-length prompt got %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for an over-length prompt", got)
+	}
+
+	// The limit is on decoded characters: "héllo wörl" is 10, though its name and its hex are longer
+	if m := exchange(t, newQuery(`h\195\169llo.w\195\182rl`, dns.TypeTXT)); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("10 character prompt got %s, want NOERROR", dns.RcodeToString[m.Rcode])
+	}
+	setForTest(t, &queryEncoding, encodingHex)
+	if m := exchange(t, newQuery(hex.EncodeToString([]byte("what is go")), dns.TypeTXT)); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("hex-encoded 10 character prompt got %s, want NOERROR", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestPagingThroughAnswer(t *testing.T) {
+	useFreshCache(t)
+	answer := strings.TrimSpace(strings.Repeat("Paged answers come one chunk at a time. ", 15))
+	calls := stubGenerate(t, answerWith(answer))
+	setForTest(t, &paging, true)
+	chunks := chunkString(answer, txtMaxStringLen)
+	if len(chunks) != 3 {
+		t.Fatalf("answer is %d chunks, want 3 for this test", len(chunks))
+	}
+
+	var pages []string
+	for i := range chunks {
+		m := exchange(t, newQuery(fmt.Sprintf("%d.tell.me.more", i), dns.TypeTXT))
+		if got := txtStrings(m); len(got) != 1 || got[0] != chunks[i] {
+			t.Errorf("page %d got %q, want chunk %d", i, got, i)
+		}
+		pages = append(pages, txtStrings(m)...)
+	}
+	if strings.Join(pages, "") != answer {
+		t.Error("pages don't join back to the answer")
+	}
+	if m := exchange(t, newQuery("3.tell.me.more", dns.TypeTXT)); m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+		t.Errorf("page past the end got %s with %d answers, want NXDOMAIN", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want every page served from one cached answer", got)
+	}
+
+	for _, name := range []string{"next.tell.me.more", "-1.tell.me.more", "0"} {
+		if m := exchange(t, newQuery(name, dns.TypeTXT)); m.Rcode != dns.RcodeFormatError {
+			t.Errorf("%s got %s, want FORMERR for a bad cursor", name, dns.RcodeToString[m.Rcode])
+		}
+	}
+}
+
+func TestNoCoalesceGeneratesForEachQuery(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &noCoalesce, true)
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		entered <- struct{}{}
+		<-release
+		return []string{"An answer."}, nil
+	})
+
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := getOrCreateLLMRequest(context.Background(), "same question", false)
+			errs <- err
+		}()
+	}
+	// Both generate at once, rather than the second waiting on the first
+	for range 2 {
+		select {
+		case <-entered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for both queries to generate")
+		}
+	}
+	close(release)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("generated %d times, want 2 with -no-coalesce", got)
+	}
+}
+
+func TestPanickingGeneratorRecovers(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &negativeTTL, 0)
+	var panicking atomic.Bool
+	panicking.Store(true)
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		if panicking.Load() {
+			panic("generator exploded")
+		}
+		return []string{"Recovered."}, nil
+	})
+
+	_, err := getOrCreateLLMRequest(context.Background(), "explosive question", false)
+	if err == nil || !strings.Contains(err.Error(), "generator exploded") {
+		t.Fatalf("got %v, want the panic as an error", err)
+	}
+	if m := exchange(t, newQuery("explosive.question", dns.TypeTXT)); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query during the panics got %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	inFlightMutex.Lock()
+	leaked := len(inFlightRequests)
+	inFlightMutex.Unlock()
+	if leaked != 0 {
+		t.Errorf("%d requests left in flight after panics", leaked)
+	}
+
+	// Once the generator behaves, the same query isn't wedged behind the panicked one
+	panicking.Store(false)
+	result, err := getOrCreateLLMRequest(context.Background(), "explosive question", false)
+	if err != nil || !slices.Equal(result.answers, []string{"Recovered."}) {
+		t.Errorf("got %q, %v after the panics stopped, want the answer", result.answers, err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("generated %d times, want 3", got)
+	}
+}
+
+func TestAnswerFramingAtBoundaries(t *testing.T) {
+	useFreshCache(t)
+	// Long enough to be chunked, so the markers land in the first and last strings
+	answer := strings.TrimSpace(strings.Repeat("Framed answers are easy to spot. ", 12))
+	stubGenerate(t, answerWith(answer))
+	setForTest(t, &answerPrefix, ">>>")
+	setForTest(t, &answerSuffix, "<<<")
+
+	strs := txtStrings(exchange(t, newQuery("framed.question", dns.TypeTXT)))
+	if len(strs) < 2 {
+		t.Fatalf("got %d strings, want the answer chunked", len(strs))
+	}
+	if !strings.HasPrefix(strs[0], ">>>Framed") || !strings.HasSuffix(strs[len(strs)-1], "spot.<<<") {
+		t.Errorf("markers not at the boundaries: first %q, last %q", strs[0], strs[len(strs)-1])
+	}
+	if got := strings.Join(strs, ""); got != ">>>"+answer+"<<<" {
+		t.Errorf("reassembled %q, want the framed answer", got)
+	}
+	// Chunked together with the answer, so no string is only a bare marker or split over the limit
+	for i, s := range strs {
+		if len(s) > txtMaxStringLen || s == ">>>" || s == "<<<" {
+			t.Errorf("string %d is %q", i, s)
+		}
+	}
+}
+
+func TestChunkString(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    string
+		want []string
+	}{
+		{"empty", "", []string{""}},
+		{"single ASCII rune", "a", []string{"a"}},
+		{"single 3-byte rune", "語", []string{"語"}},
+		{"exactly 255 bytes", strings.Repeat("b", 255), []string{strings.Repeat("b", 255)}},
+	} {
+		if got := chunkString(tc.s, txtMaxStringLen); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// An empty answer is one empty character-string, which packs as a valid TXT record
+	rrs := buildTXTAnswer("empty.", 60, chunkString("", txtMaxStringLen), 0)
+	m := new(dns.Msg)
+	m.SetQuestion("empty.", dns.TypeTXT)
+	m.Answer = rrs
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+	if got := txtStrings(m); len(m.Answer) != 1 || !slices.Equal(got, []string{""}) {
+		t.Errorf("empty answer unpacked as %d records holding %q, want one empty string", len(m.Answer), got)
+	}
+}
+
+func TestApplyAnswerBounds(t *testing.T) {
+	setForTest(t, &minAnswerLen, 5)
+	setForTest(t, &maxAnswerLen, 10)
+	for _, tc := range []struct {
+		in      []string
+		want    []string
+		wantErr error
+	}{
+		{[]string{"Just fine"}, []string{"Just fine"}, nil},
+		{[]string{"Exactly 10"}, []string{"Exactly 10"}, nil},
+		{[]string{"Far too long an answer"}, []string{"Far too lo"}, nil},
+		// Cut at a rune boundary, so the 2-byte é straddling byte 10 is dropped whole
+		{[]string{"Ab résumé writing"}, []string{"Ab résum"}, nil},
+		{[]string{"No"}, nil, errAnswerTooShort},
+		{[]string{"No", "Maybe so", "?"}, []string{"Maybe so"}, nil},
+		{[]string{"", "No"}, nil, errAnswerTooShort},
+	} {
+		got, err := applyAnswerBounds(tc.in)
+		if !errors.Is(err, tc.wantErr) || !slices.Equal(got, tc.want) {
+			t.Errorf("applyAnswerBounds(%q) = %q, %v, want %q, %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+		for _, s := range got {
+			if !utf8.ValidString(s) {
+				t.Errorf("applyAnswerBounds(%q) split a rune: %q", tc.in, s)
+			}
+		}
+	}
+}
+
+func TestAnswerBoundsApplyBeforeCaching(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &maxAnswerLen, 20)
+	setForTest(t, &minAnswerLen, 3)
+	setForTest(t, &fallbackAnswer, "")
+	stubGenerate(t, func(_ context.Context, q string) ([]string, error) {
+		if q == "short" {
+			return []string{"No"}, nil
+		}
+		return []string{"An answer that is much longer than twenty bytes."}, nil
+	})
+
+	if m := exchange(t, newQuery("long", dns.TypeTXT)); !slices.Equal(txtStrings(m), []string{"An answer that is mu"}) {
+		t.Errorf("long answer got %q, want it truncated to 20 bytes", txtStrings(m))
+	}
+	if entry, ok := responseCache.Get(cacheKey("long")); !ok || entry.response != "An answer that is mu" {
+		t.Errorf("cached %q, want the truncated answer", entry.response)
+	}
+	if m := exchange(t, newQuery("short", dns.TypeTXT)); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("short answer got %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if entry, _ := responseCache.Get(cacheKey("short")); entry.response != "" {
+		t.Errorf("cached the short answer %q", entry.response)
+	}
+}
+
+func TestNonTXTQueryResponse(t *testing.T) {
+	calls := stubGenerate(t, answerWith("An answer."))
+	for _, tc := range []struct {
+		mode  string
+		rcode int
+	}{
+		{nondataNotImpl, dns.RcodeNotImplemented},
+		{nondataNoData, dns.RcodeSuccess},
+	} {
+		setForTest(t, &nondataResponse, tc.mode)
+		m := exchange(t, newQuery("what.is.go", dns.TypeA))
+		if m.Rcode != tc.rcode || len(m.Answer) != 0 {
+			t.Errorf("%s: A query got %s with %d answers, want %s with none", tc.mode, dns.RcodeToString[m.Rcode], len(m.Answer), dns.RcodeToString[tc.rcode])
+		}
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for A queries", got)
+	}
+}
+
+func TestReplyFlags(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &zone, "chat.example.com.")
+
+	r := newQuery("what.is.go.chat.example.com", dns.TypeTXT)
+	r.RecursionDesired = true
+	m := exchange(t, r)
+	if !m.Authoritative || m.RecursionAvailable || !m.RecursionDesired {
+		t.Errorf("in-zone answer has AA=%v RA=%v RD=%v, want AA set, RA clear and RD copied", m.Authoritative, m.RecursionAvailable, m.RecursionDesired)
+	}
+
+	r = newQuery("google.com", dns.TypeTXT)
+	r.RecursionDesired = false
+	m = exchange(t, r)
+	if m.Authoritative || m.RecursionAvailable || m.RecursionDesired {
+		t.Errorf("out-of-zone reply has AA=%v RA=%v RD=%v, want all clear", m.Authoritative, m.RecursionAvailable, m.RecursionDesired)
+	}
+}
+
+func TestDebugAnswerReportsCacheHit(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &debugAnswer, true)
+
+	for _, want := range []string{"cache=miss", "cache=hit"} {
+		got := txtStrings(exchange(t, newQuery("am.i.cached", dns.TypeTXT)))
+		if !slices.Equal(got, []string{"An answer.", want}) {
+			t.Errorf("got %q, want the answer then %s", got, want)
+		}
+	}
+
+	setForTest(t, &debugAnswer, false)
+	if got := txtStrings(exchange(t, newQuery("am.i.cached", dns.TypeTXT))); !slices.Equal(got, []string{"An answer."}) {
+		t.Errorf("without -debug-answer got %q, want only the answer", got)
+	}
+}
+
+func TestMaxInflightQueriesRefusesExcess(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &maxInflightQueries, 3)
+	release := make(chan struct{})
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		<-release
+		return []string{"An answer."}, nil
+	})
+
+	held := make(chan *dns.Msg, 3)
+	for i := range 3 {
+		go func() { held <- exchangeFrom(testClientAddr, newQuery(fmt.Sprintf("held.%d", i), dns.TypeTXT)) }()
+	}
+	waitFor(t, "the limit's worth of queries to be generating", func() bool { return calls.Load() == 3 })
+
+	var wg sync.WaitGroup
+	var refused atomic.Int64
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m := exchangeFrom(testClientAddr, newQuery(fmt.Sprintf("excess.%d", i), dns.TypeTXT)); m != nil && m.Rcode == dns.RcodeRefused {
+				refused.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := refused.Load(); got != 20 {
+		t.Errorf("%d of 20 queries over the limit refused, want all", got)
+	}
+
+	close(release)
+	for range 3 {
+		if m := <-held; m == nil || m.Rcode != dns.RcodeSuccess {
+			t.Errorf("query within the limit got %v, want NOERROR", m)
+		}
+	}
+	if m := exchange(t, newQuery("after.the.burst", dns.TypeTXT)); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("query after the burst got %s, want NOERROR once slots are free", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestResponsesSentToServerAreDropped(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	r := newQuery("reflected.question", dns.TypeTXT)
+	r.Response = true
+
+	if m := exchangeFrom(testClientAddr, r); m != nil {
+		t.Errorf("got reply %v to a message with QR set, want it dropped", m)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for a response", got)
+	}
+}
+
+func TestCanonicalOwner(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	for _, tc := range []struct {
+		canonical bool
+		want      string
+	}{
+		{false, "WhAt.Is.Go.Chat.Example.COM."},
+		{true, "what.is.go.chat.example.com."},
+	} {
+		setForTest(t, &canonicalOwner, tc.canonical)
+		m := exchange(t, newQuery("WhAt.Is.Go.Chat.Example.COM", dns.TypeTXT))
+		if got := m.Answer[0].Header().Name; got != tc.want {
+			t.Errorf("canonical=%v: owner %q, want %q", tc.canonical, got, tc.want)
+		}
+		// The question section is echoed unchanged either way
+		if got := m.Question[0].Name; got != "WhAt.Is.Go.Chat.Example.COM." {
+			t.Errorf("canonical=%v: question echoed as %q", tc.canonical, got)
+		}
+	}
+}
+
+func TestAsyncAnswersPendingThenAnswer(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &asyncAnswers, true)
+	release := make(chan struct{})
+	calls := stubGenerate(t, func(context.Context, string) ([]string, error) {
+		<-release
+		return []string{"The real answer."}, nil
+	})
+
+	// Queries while it's being generated are answered pending, with a TTL of 0 so resolvers ask again
+	for i := range 2 {
+		m := exchange(t, newQuery("slow.question", dns.TypeTXT))
+		if got := txtStrings(m); !slices.Equal(got, []string{pendingAnswer}) {
+			t.Fatalf("query %d answered %q, want %q", i, got, pendingAnswer)
+		}
+		if ttl := m.Answer[0].Header().Ttl; ttl != 0 {
+			t.Errorf("pending answer has TTL %d, want 0", ttl)
+		}
+	}
+
+	close(release)
+	waitFor(t, "the background generation to be cached", func() bool {
+		_, ok := getCache(cacheKey("slow question"))
+		return ok
+	})
+	if got := txtStrings(exchange(t, newQuery("slow.question", dns.TypeTXT))); !slices.Equal(got, []string{"The real answer."}) {
+		t.Errorf("answered %q once generated, want the real answer", got)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want polling queries to share one generation", got)
+	}
+}
+
+func TestBase64AnswerRoundTrip(t *testing.T) {
+	useFreshCache(t)
+	setForTest(t, &answerEncoding, answerEncodingBase64)
+	// Punctuation and non-ASCII cleanResponse would strip, long enough to need several strings once encoded
+	answer := strings.TrimSpace(strings.Repeat("Café crème — naïve résumé: 50% off, \"quoted\" & <tagged>! ", 6))
+	useProvider(t, &fakeProvider{generate: func(context.Context, string) (string, error) {
+		return answer, nil
+	}})
+
+	m := exchangeTCP(t, newQuery("what.is.on.the.menu", dns.TypeTXT))
+	strs := txtStrings(m)
+	if len(strs) < 2 {
+		t.Fatalf("got %d strings, want the encoded answer split over several", len(strs))
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strs, ""))
+	if err != nil {
+		t.Fatalf("joined strings aren't base64: %v", err)
+	}
+	if string(decoded) != answer {
+		t.Errorf("decoded %q, want the LLM's answer unchanged %q", decoded, answer)
+	}
+}
+
+func TestAnswerSignatureWithKnownKey(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("Go is a language."))
+	setForTest(t, &answerHMACKey, []byte("secret"))
+
+	// HMAC-SHA256 with key "secret" of "what.is.go.\nGo is a language.", computed independently
+	const want = "hmac-sha256=ae6d07e7fecb8ea7892d75b6da700a5abf8497811c897addbe01a181d215040b"
+	// The name is signed lowercased, so 0x20 case randomization doesn't change the signature
+	for _, name := range []string{"what.is.go", "WHAT.is.Go"} {
+		got := txtStrings(exchange(t, newQuery(name, dns.TypeTXT)))
+		if !slices.Equal(got, []string{"Go is a language.", want}) {
+			t.Errorf("%s answered %q, want the answer then %q", name, got, want)
+		}
+	}
+
+	// A different question or key gives a different signature
+	if got := answerSignature("what.is.dns.", "Go is a language."); got == want {
+		t.Error("signature doesn't depend on the question")
+	}
+	setForTest(t, &answerHMACKey, []byte("other"))
+	if got := answerSignature("what.is.go.", "Go is a language."); got == want {
+		t.Error("signature doesn't depend on the key")
+	}
+}
+
+func TestMaxStringsPerRR(t *testing.T) {
+	useFreshCache(t)
+	// Ten full strings and a bit more
+	answer := strings.Repeat("a", 10*txtMaxStringLen+20)
+	stubGenerate(t, answerWith(answer))
+
+	for _, tc := range []struct {
+		perRR int
+		want  []int
+	}{
+		{3, []int{3, 3, 3, 2}},
+		{4, []int{4, 4, 3}},
+		{11, []int{11}},
+		// 0 means unlimited, keeping the whole answer in one record
+		{0, []int{11}},
+	} {
+		setForTest(t, &maxStringsPerRR, tc.perRR)
+		m := exchangeTCP(t, newQuery("long.question", dns.TypeTXT))
+		var counts []int
+		for _, rr := range m.Answer {
+			counts = append(counts, len(rr.(*dns.TXT).Txt))
+		}
+		if !slices.Equal(counts, tc.want) {
+			t.Errorf("-max-strings-per-rr %d gave records of %v strings, want %v", tc.perRR, counts, tc.want)
+		}
+		// Records are in order, so joining them gives the answer back
+		if got := strings.Join(txtStrings(m), ""); got != answer {
+			t.Errorf("-max-strings-per-rr %d reassembled %d bytes, want %d", tc.perRR, len(got), len(answer))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnschat_queries_total",
+		Help: "Total DNS queries received.",
+	})
+	cacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnschat_cache_hits_total",
+		Help: "Cache lookups that found a fresh response.",
+	})
+	cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnschat_cache_misses_total",
+		Help: "Cache lookups that found no fresh response.",
+	})
+	cacheStaleHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnschat_cache_stale_hits_total",
+		Help: "Cache lookups that found an expired response to serve while refreshing it.",
+	})
+	cacheCompressionSavedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dnschat_cache_compression_saved_bytes",
+		Help: "Bytes -compress-cache saves across the responses in the memory cache.",
+	})
+	inFlightDedupTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnschat_inflight_dedup_total",
+		Help: "Queries that waited on an identical in-flight generation instead of calling the LLM.",
+	})
+	llmErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnschat_llm_errors_total",
+		Help: "LLM generations that failed.",
+	})
+	llmTokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dnschat_llm_tokens_total",
+		Help: "Tokens LLM APIs reported using, by input for prompts or output for answers.",
+	}, []string{"type"})
+	tokensUsedToday = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dnschat_llm_tokens_used_today",
+		Help: "Tokens LLM APIs reported using since midnight UTC, counted against -daily-token-budget.",
+	})
+	breakerStateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dnschat_llm_circuit_breaker_state",
+		Help: "State of the LLM circuit breaker, 0 for closed, 1 for open, and 2 for half-open.",
+	})
+	llmLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dnschat_llm_request_duration_seconds",
+		Help:    "Time taken to generate a response from the LLM.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 3, 5, 7.5, 10, 15, 30},
+	})
+)
+
+// newMetricsMux returns the handler for the metrics HTTP server, which also serves health checks and, if enabled, /ask
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	if askEnabled {
+		mux.HandleFunc("/ask", handleAsk)
+	}
+	return mux
+}
+
+// runHTTPServer serves handler on addr until ctx is cancelled.
+// Errors are logged rather than fatal, so a broken metrics server doesn't take down the DNS listener.
+func runHTTPServer(ctx context.Context, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Starting metrics server", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Metrics server failed", "addr", addr, "error", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// loadPreloadFile reads one prompt per line, skipping blank lines and # comments
+func loadPreloadFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prompts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prompts = append(prompts, normalizePrompt(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return prompts, nil
+}
+
+// preloadCache generates answers for prompts with at most workers running at once, returning how many
+// succeeded. Failures are logged and skipped, as a cold entry is no worse than not preloading.
+func preloadCache(ctx context.Context, prompts []string, workers int) int {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan string)
+	var succeeded atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prompt := range jobs {
+				if _, err := getOrCreateLLMRequest(ctx, prompt, false); err != nil {
+					logger.Warn("Failed to preload prompt", "error", err)
+					continue
+				}
+				succeeded.Add(1)
+			}
+		}()
+	}
+
+	for _, prompt := range prompts {
+		select {
+		case jobs <- prompt:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return int(succeeded.Load())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPreloadFillsCache(t *testing.T) {
+	c := useFreshCache(t)
+	calls := stubGenerate(t, func(_ context.Context, q string) ([]string, error) {
+		if q == "broken prompt" {
+			return nil, ErrUpstreamUnavailable
+		}
+		return []string{"Preloaded answer to " + q}, nil
+	})
+	path := filepath.Join(t.TempDir(), "preload.txt")
+	content := "# Common questions\nWhat is Go\n\n  what   is   DNS  \nbroken prompt\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	prompts, err := loadPreloadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"what is go", "what is dns", "broken prompt"}; !slices.Equal(prompts, want) {
+		t.Fatalf("loaded %q, want %q", prompts, want)
+	}
+	if got := preloadCache(context.Background(), prompts, 2); got != 2 {
+		t.Errorf("%d prompts preloaded, want 2 with one failing", got)
+	}
+
+	for _, prompt := range []string{"what is go", "what is dns"} {
+		entry, ok := c.Get(cacheKey(prompt))
+		if !ok || entry.failed || entry.response != "Preloaded answer to "+prompt {
+			t.Errorf("%q cached as %+v, want its preloaded answer", prompt, entry)
+		}
+	}
+	// A DNS query for a preloaded prompt is a cache hit
+	before := calls.Load()
+	if got := txtStrings(exchange(t, newQuery("What.Is.Go", dns.TypeTXT))); !slices.Equal(got, []string{"Preloaded answer to what is go"}) {
+		t.Errorf("query got %q, want the preloaded answer", got)
+	}
+	if calls.Load() != before {
+		t.Error("query for a preloaded prompt generated again")
+	}
+}
+
+func TestPreloadFileMissing(t *testing.T) {
+	if _, err := loadPreloadFile(filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a not-exist error", err)
+	}
+}
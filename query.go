@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Encodings clients can use to fit arbitrary prompts into DNS labels
+const (
+	encodingNone   = "none"
+	encodingBase32 = "base32"
+	encodingHex    = "hex"
+)
+
+var (
+	// zone is the base zone the server answers for, stripped from query names before prompting, set in main
+	zone string
+	// queryEncoding is how the prompt is encoded in the query labels, set in main
+	queryEncoding = encodingNone
+	// stripTrailingDot leaves the root label's dot off prompts and logged names, set in main
+	stripTrailingDot = true
+	// lowercaseNames lowercases prompts and logged names, so case variants of a query share a cache entry, set in main
+	lowercaseNames = true
+	// nfcNames puts prompts and logged names in Unicode NFC form, set in main
+	nfcNames = true
+	// paging treats the first label as a cursor selecting one chunk of the answer, set in main
+	paging bool
+)
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// queryToPrompt turns a query name like what.is.go.chat.example.com. into the prompt "what is go",
+// removing the zone suffix and using the labels as words, normalized by NormalizeName.
+// With base32 or hex encoding the labels are joined and decoded instead, and the prompt only put in NFC form
+// if nfcNames is set, as the encoding carries its case and punctuation exactly.
+func queryToPrompt(name, zone, encoding string) (string, error) {
+	if zone != "" && dns.IsSubDomain(zone, name) {
+		name = name[:len(name)-len(zone)]
+	}
+	trailingDot := strings.HasSuffix(name, ".")
+	name = strings.TrimSuffix(name, ".")
+
+	var prompt string
+	switch encoding {
+	case encodingNone, "":
+		// Labels are unescaped so bytes the wire format shows as \DDD, like UTF-8, reach the prompt as sent
+		labels := dns.SplitDomainName(name)
+		for i, label := range labels {
+			labels[i] = unescapeLabel(label)
+		}
+		prompt = strings.Join(labels, " ")
+		if !utf8.ValidString(prompt) {
+			return "", errors.New("query is not valid UTF-8")
+		}
+		// Normalized after unescaping, so lowercasing and NFC cover non-ASCII letters too
+		if trailingDot {
+			prompt += "."
+		}
+		return NormalizeName(prompt), nil
+	case encodingBase32:
+		data := strings.ToUpper(strings.ReplaceAll(name, ".", ""))
+		decoded, err := base32Encoding.DecodeString(strings.TrimRight(data, "="))
+		if err != nil {
+			return "", fmt.Errorf("invalid base32 query: %w", err)
+		}
+		prompt = string(decoded)
+	case encodingHex:
+		decoded, err := hex.DecodeString(strings.ReplaceAll(name, ".", ""))
+		if err != nil {
+			return "", fmt.Errorf("invalid hex query: %w", err)
+		}
+		prompt = string(decoded)
+	default:
+		return "", fmt.Errorf("unknown encoding %q", encoding)
+	}
+
+	if !utf8.ValidString(prompt) {
+		return "", errors.New("decoded query is not valid UTF-8")
+	}
+	if nfcNames {
+		prompt = norm.NFC.String(prompt)
+	}
+	return prompt, nil
+}
+
+// unescapeLabel turns the presentation form of a label, with escapes like \. and \195, back into its raw bytes
+func unescapeLabel(label string) string {
+	if !strings.Contains(label, `\`) {
+		return label
+	}
+	buf := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			buf = append(buf, label[i])
+			continue
+		}
+		if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+			if n, err := strconv.Atoi(label[i+1 : i+4]); err == nil && n <= 255 {
+				buf = append(buf, byte(n))
+				i += 3
+				continue
+			}
+		}
+		buf = append(buf, label[i+1])
+		i++
+	}
+	return string(buf)
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// NormalizeName puts a query name, or a prompt made from one, in the form used for prompting, caching, and
+// logging, so variants of a question that mean the same thing share a cache entry and in-flight generation.
+// Each step is toggled by a flag: stripTrailingDot removes the root label's dot, lowercaseNames lowercases,
+// as DNS names are case-insensitive and resolvers using DNS 0x20 randomize the case, and nfcNames applies
+// Unicode NFC, so an accented letter sent precomposed or as a base letter and combining mark is the same.
+func NormalizeName(name string) string {
+	if stripTrailingDot && name != "." {
+		name = strings.TrimSuffix(name, ".")
+	}
+	return normalizeText(name)
+}
+
+// normalizePrompt collapses the whitespace of free text and normalizes it like NormalizeName, so prompts that
+// don't arrive as query names, like preloaded or HTTP ones, share cache entries with the same question over DNS.
+// It has no root label, so any trailing dot is kept as part of the text.
+func normalizePrompt(text string) string {
+	return normalizeText(strings.Join(strings.Fields(text), " "))
+}
+
+// normalizeText applies the lowercaseNames and nfcNames steps of NormalizeName
+func normalizeText(text string) string {
+	if lowercaseNames {
+		text = strings.ToLower(text)
+	}
+	if nfcNames {
+		text = norm.NFC.String(text)
+	}
+	return text
+}
+
+// splitFirstLabel splits a name into its first label and the rest of the name
+func splitFirstLabel(name string) (string, string, bool) {
+	idx := dns.Split(name)
+	if len(idx) < 2 {
+		return "", "", false
+	}
+	return name[:idx[1]-1], name[idx[1]:], true
+}
+
+// splitCursor splits a paging query like 2.what.is.go.chat.example.com. into the cursor 2 and
+// the name of the question it pages through
+func splitCursor(name string) (int, string, error) {
+	label, rest, ok := splitFirstLabel(name)
+	if !ok {
+		return 0, "", errors.New("paging query has no question after the cursor")
+	}
+	cursor, err := strconv.Atoi(label)
+	if err != nil || cursor < 0 {
+		return 0, "", fmt.Errorf("invalid cursor %q", label)
+	}
+	return cursor, rest, nil
+}
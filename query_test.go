@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryToPrompt(t *testing.T) {
+	for _, tc := range []struct {
+		name, zone, want string
+	}{
+		{"what.is.go.chat.example.com.", "chat.example.com.", "what is go"},
+		{"what.is.go.", "", "what is go"},
+		{"what.is.go.other.org.", "chat.example.com.", "what is go other org"},
+		{"What.Is.GO.chat.example.com.", "chat.example.com.", "what is go"},
+		{`a\.b.c.`, "", "a.b c"},
+		{"hello.", "", "hello"},
+		{"hello", "", "hello"},
+		{"what is go", "", "what is go"},
+	} {
+		got, err := queryToPrompt(tc.name, tc.zone, encodingNone)
+		if err != nil {
+			t.Errorf("queryToPrompt(%q, %q): %v", tc.name, tc.zone, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("queryToPrompt(%q, %q) = %q, want %q", tc.name, tc.zone, got, tc.want)
+		}
+	}
+}
+
+// encodeQuery encodes prompt into labels of at most 63 characters under zone, as a client would
+func encodeQuery(prompt, encoding, zone string) string {
+	var data string
+	switch encoding {
+	case encodingBase32:
+		data = strings.ToLower(base32Encoding.EncodeToString([]byte(prompt)))
+	case encodingHex:
+		data = hex.EncodeToString([]byte(prompt))
+	default:
+		return strings.ReplaceAll(prompt, " ", ".") + "." + zone
+	}
+	var labels []string
+	for len(data) > 63 {
+		labels = append(labels, data[:63])
+		data = data[63:]
+	}
+	return strings.Join(append(labels, data), ".") + "." + zone
+}
+
+func TestQueryEncodingsRoundTrip(t *testing.T) {
+	const zone = "chat.example.com."
+	long := "a question long enough to need two labels"
+	for _, tc := range []struct {
+		encoding string
+		prompts  []string
+	}{
+		{encodingNone, []string{"what is go", "héllo wörld"}},
+		{encodingBase32, []string{"What is Go?", "¿Qué hora es?", long}},
+		{encodingHex, []string{"What is Go?", "¿Qué hora es?", long}},
+	} {
+		for _, prompt := range tc.prompts {
+			name := encodeQuery(prompt, tc.encoding, zone)
+			if _, ok := dns.IsDomainName(name); !ok {
+				t.Fatalf("%s: %q encoded to invalid name %q", tc.encoding, prompt, name)
+			}
+			got, err := queryToPrompt(name, zone, tc.encoding)
+			if err != nil {
+				t.Errorf("%s: decoding %q: %v", tc.encoding, name, err)
+				continue
+			}
+			if got != prompt {
+				t.Errorf("%s: %q round tripped to %q", tc.encoding, prompt, got)
+			}
+		}
+	}
+}
+
+func TestQueryEncodingsRejectBadInput(t *testing.T) {
+	for _, tc := range []struct {
+		name, encoding string
+	}{
+		{"not!base32.", encodingBase32},
+		{"xyz.", encodingHex},
+		{"abc.", encodingHex},
+		// Valid hex, but not valid UTF-8 once decoded
+		{"ff.", encodingHex},
+		{"74.65.73.74.", "rot13"},
+	} {
+		if got, err := queryToPrompt(tc.name, "", tc.encoding); err == nil {
+			t.Errorf("%s: %q decoded to %q, want an error", tc.encoding, tc.name, got)
+		}
+	}
+
+	setForTest(t, &queryEncoding, encodingHex)
+	if m := exchange(t, newQuery("xyz", dns.TypeTXT)); m.Rcode != dns.RcodeFormatError {
+		t.Errorf("undecodable query got %s, want FORMERR", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestInvalidUTF8LabelGetsFORMERR(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+
+	// \255 and a lone continuation byte \128 aren't valid UTF-8, \195\169 is é
+	for _, name := range []string{`bad\255.label`, `bad\128label`, `\195.truncated`} {
+		if _, err := queryToPrompt(dns.Fqdn(name), "", encodingNone); err == nil {
+			t.Errorf("%s decoded, want an invalid UTF-8 error", name)
+		}
+		if m := exchange(t, newQuery(name, dns.TypeTXT)); m.Rcode != dns.RcodeFormatError {
+			t.Errorf("%s got %s, want FORMERR", name, dns.RcodeToString[m.Rcode])
+		}
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for invalid UTF-8", got)
+	}
+
+	if got, err := queryToPrompt(`caf\195\169.`, "", encodingNone); err != nil || got != "café" {
+		t.Errorf("valid escaped UTF-8 decoded to %q, %v, want café", got, err)
+	}
+}
+
+func TestStripTrailingDot(t *testing.T) {
+	for _, tc := range []struct {
+		strip bool
+		want  string
+	}{
+		{true, "what is go"},
+		{false, "what is go."},
+	} {
+		useFreshCache(t)
+		setForTest(t, &stripTrailingDot, tc.strip)
+		var prompt atomic.Value
+		stubGenerate(t, func(_ context.Context, q string) ([]string, error) {
+			prompt.Store(q)
+			return []string{"An answer."}, nil
+		})
+
+		if got, err := queryToPrompt("what.is.go.", "", encodingNone); err != nil || got != tc.want {
+			t.Errorf("strip=%v: queryToPrompt got %q, %v, want %q", tc.strip, got, err, tc.want)
+		}
+		m := exchange(t, newQuery("what.is.go", dns.TypeTXT))
+		if got, _ := prompt.Load().(string); got != tc.want {
+			t.Errorf("strip=%v: prompted with %q, want %q", tc.strip, got, tc.want)
+		}
+		// The answer's owner is the FQDN either way
+		if got := m.Answer[0].Header().Name; got != "what.is.go." {
+			t.Errorf("strip=%v: answer owner %q, want the FQDN", tc.strip, got)
+		}
+	}
+}
+
+func TestNFCAndNFDShareACacheKey(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("A small cafe."))
+
+	// é precomposed as U+00E9, and as e followed by the combining acute accent U+0301
+	const nfc, nfd = `caf\195\169.near.me`, `cafe\204\129.near.me`
+	promptNFC, err := queryToPrompt(dns.Fqdn(nfc), "", encodingNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	promptNFD, err := queryToPrompt(dns.Fqdn(nfd), "", encodingNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promptNFC != promptNFD || cacheKey(promptNFC) != cacheKey(promptNFD) {
+		t.Errorf("NFC prompt %+q and NFD prompt %+q don't share a cache key", promptNFC, promptNFD)
+	}
+
+	exchange(t, newQuery(nfc, dns.TypeTXT))
+	exchange(t, newQuery(nfd, dns.TypeTXT))
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want both forms answered from one cache entry", got)
+	}
+
+	// Without normalization the forms are told apart
+	setForTest(t, &nfcNames, false)
+	promptNFD, _ = queryToPrompt(dns.Fqdn(nfd), "", encodingNone)
+	if promptNFD == promptNFC {
+		t.Errorf("NFD prompt %+q put in NFC form with -nfc-names=false", promptNFD)
+	}
+}
+
+func TestNormalizeNameToggles(t *testing.T) {
+	// A decomposed é, mixed case, and the root label's dot give every step something to change
+	const name = "Cafe\u0301 LATTE."
+	for _, tc := range []struct {
+		strip, lower, nfc bool
+		want              string
+	}{
+		{false, false, false, "Cafe\u0301 LATTE."},
+		{true, false, false, "Cafe\u0301 LATTE"},
+		{false, true, false, "cafe\u0301 latte."},
+		{false, false, true, "Caf\u00e9 LATTE."},
+		{true, true, false, "cafe\u0301 latte"},
+		{true, false, true, "Caf\u00e9 LATTE"},
+		{false, true, true, "caf\u00e9 latte."},
+		{true, true, true, "caf\u00e9 latte"},
+	} {
+		setForTest(t, &stripTrailingDot, tc.strip)
+		setForTest(t, &lowercaseNames, tc.lower)
+		setForTest(t, &nfcNames, tc.nfc)
+		if got := NormalizeName(name); got != tc.want {
+			t.Errorf("strip=%v lower=%v nfc=%v: got %+q, want %+q", tc.strip, tc.lower, tc.nfc, got, tc.want)
+		}
+		// The root name is never stripped to nothing
+		if got := NormalizeName("."); got != "." {
+			t.Errorf("strip=%v lower=%v nfc=%v: root normalized to %q", tc.strip, tc.lower, tc.nfc, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultRateBurst         = 5
+	rateLimitCleanupInterval = 1 * time.Minute
+)
+
+var (
+	// limiter rate limits queries per client IP, nil when rate limiting is disabled
+	limiter *rateLimiter
+
+	// rateLimitMessage is the TXT answer for rate limited TXT queries instead of REFUSED, empty disables it
+	rateLimitMessage string
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client IP
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow reports whether the client has budget for another query, and spends a token if so
+func (l *rateLimiter) Allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryAfter returns how long until the client has budget for another query
+func (l *rateLimiter) retryAfter(client string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.clients[client]
+	if !ok || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// writeRateLimited replies to a rate limited query, with rateLimitMessage and a retry-after hint in whole seconds
+// for TXT queries when it's set, so chat clients can show why they got no answer, and REFUSED otherwise.
+// The message has a TTL of 0, as a resolver caching it would hand it to clients that aren't over the limit.
+func writeRateLimited(w dns.ResponseWriter, r *dns.Msg, client string) {
+	q := r.Question[0]
+	if rateLimitMessage == "" || q.Qtype != dns.TypeTXT {
+		writeExtendedError(w, r, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "rate limited")
+		return
+	}
+	retry := int(math.Ceil(limiter.retryAfter(client).Seconds()))
+	m := newReply(r)
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+		Txt: append(chunkString(rateLimitMessage, txtMaxStringLen), fmt.Sprintf("retry-after=%d", max(retry, 1))),
+	}}
+	// A long -rate-limit-message is held to the same UDP limit as any answer
+	truncateForUDP(w, r, m)
+	w.WriteMsg(m)
+}
+
+// cleanup removes clients whose bucket has refilled, as they are no different from a new client
+func (l *rateLimiter) cleanup() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	removed := 0
+	for client, b := range l.clients {
+		if time.Since(b.last) >= refill {
+			delete(l.clients, client)
+			removed++
+		}
+	}
+	return removed
+}
+
+// runCleanup removes idle clients every interval until ctx is cancelled
+func (l *rateLimiter) runCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := l.cleanup(); removed > 0 {
+				logger.Debug("Removed idle rate limit clients", "count", removed)
+			}
+		}
+	}
+}
+
+// clientIP returns the IP address of the client that sent a query, without an IPv6 zone and with IPv4 clients
+// of a dual-stack listener in their IPv4 form, so the same client always gets the same rate limit and ACL checks
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		// Not host:port, which might be a bare address
+		host = addr.String()
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	return ip.Unmap().WithZone("").String()
+}
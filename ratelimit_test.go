@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimitRefusesClientOverBudget(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &limiter, newRateLimiter(0.001, 3))
+
+	for i := range 3 {
+		if m := exchange(t, newQuery("within.budget", dns.TypeTXT)); m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("query %d got %s, want NOERROR within the burst", i, dns.RcodeToString[m.Rcode])
+		}
+	}
+	m := exchange(t, newQuery("over.budget", dns.TypeTXT))
+	if m.Rcode != dns.RcodeRefused {
+		t.Errorf("query over the burst got %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want the refused query never to reach the LLM", got)
+	}
+
+	// Other clients have budgets of their own
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}
+	if m := exchangeFrom(other, newQuery("within.budget", dns.TypeTXT)); m == nil || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("another client got %v, want NOERROR", m)
+	}
+}
+
+func TestRateLimitRefills(t *testing.T) {
+	l := newRateLimiter(50, 1)
+	if !l.Allow("192.0.2.1") {
+		t.Fatal("first query refused")
+	}
+	if l.Allow("192.0.2.1") {
+		t.Fatal("second query allowed straight away, want it over the burst of 1")
+	}
+	if wait := l.retryAfter("192.0.2.1"); wait <= 0 || wait > 20*time.Millisecond {
+		t.Errorf("retry after %s, want at most 20ms at 50 queries a second", wait)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if !l.Allow("192.0.2.1") {
+		t.Error("query refused after the bucket refilled")
+	}
+}
+
+func TestRateLimitCleanupRemovesIdleClients(t *testing.T) {
+	// A bucket of 1 refills in 10ms
+	l := newRateLimiter(100, 1)
+	l.Allow("192.0.2.1")
+	time.Sleep(15 * time.Millisecond)
+	l.Allow("192.0.2.2")
+	l.Allow("192.0.2.2")
+	if removed := l.cleanup(); removed != 1 {
+		t.Errorf("removed %d clients, want only the idle one", removed)
+	}
+	if _, ok := l.clients["192.0.2.2"]; !ok {
+		t.Error("removed a client that's still over its burst")
+	}
+}
+
+func TestRateLimitMessageForThrottledClient(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	// One query, then a token every 2 seconds
+	setForTest(t, &limiter, newRateLimiter(0.5, 1))
+	setForTest(t, &rateLimitMessage, "Slow down, you are asking too fast.")
+
+	exchange(t, newQuery("first.question", dns.TypeTXT))
+	m := exchange(t, newQuery("second.question", dns.TypeTXT))
+	if m.Rcode != dns.RcodeSuccess {
+		t.Fatalf("throttled client got %s, want NOERROR with the message", dns.RcodeToString[m.Rcode])
+	}
+	if got := txtStrings(m); !slices.Equal(got, []string{"Slow down, you are asking too fast.", "retry-after=2"}) {
+		t.Errorf("throttled client got %q, want the message and a retry-after hint", got)
+	}
+	// Cached by a resolver, the message would reach clients that aren't over the limit
+	if ttl := m.Answer[0].Header().Ttl; ttl != 0 {
+		t.Errorf("message has TTL %d, want 0", ttl)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want the throttled query never to reach the LLM", got)
+	}
+
+	// Other query types can't carry the message, so they're still refused
+	if m := exchange(t, newQuery("second.question", dns.TypeA)); m.Rcode != dns.RcodeRefused {
+		t.Errorf("throttled A query got %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestLongRateLimitMessageIsTruncatedOverUDP(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &limiter, newRateLimiter(0.001, 1))
+	message := strings.Repeat("Slow down. ", 100)
+	setForTest(t, &rateLimitMessage, message)
+
+	exchange(t, newQuery("first.question", dns.TypeTXT))
+	m := exchange(t, newQuery("second.question", dns.TypeTXT))
+	if !m.Truncated || len(m.Answer) != 0 {
+		t.Fatalf("got %d answers with TC=%v, want an empty truncated reply to a 512 byte UDP client", len(m.Answer), m.Truncated)
+	}
+	// The retry over TCP gets the whole message
+	m = exchangeTCP(t, newQuery("second.question", dns.TypeTXT))
+	if m.Truncated || strings.Join(txtStrings(m), "") != message+"retry-after=1000" {
+		t.Errorf("TCP retry got %q with TC=%v, want the whole message", txtStrings(m), m.Truncated)
+	}
+}
+
+// stringAddr is a net.Addr of another network, known only by its string form
+type stringAddr string
+
+func (a stringAddr) Network() string { return "test" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestClientIPWithIPv6(t *testing.T) {
+	for _, tc := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, "2001:db8::1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, "2001:db8::1"},
+		// Link-local clients come with a zone, which mustn't give them separate budgets per interface
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 5353, Zone: "eth0"}, "fe80::1"},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5353, Zone: "eth1"}, "fe80::1"},
+		// IPv4 clients of a dual-stack listener arrive IPv4-mapped
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5353}, "192.0.2.1"},
+		{stringAddr("[fe80::1%eth0]:53"), "fe80::1"},
+		{stringAddr("[::ffff:192.0.2.1]:53"), "192.0.2.1"},
+		{stringAddr("2001:db8::1"), "2001:db8::1"},
+		{stringAddr("192.0.2.1:53"), "192.0.2.1"},
+		{stringAddr("not-an-ip"), "not-an-ip"},
+	} {
+		if got := clientIP(tc.addr); got != tc.want {
+			t.Errorf("clientIP(%s) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitSharesBudgetAcrossIPv6Zones(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &limiter, newRateLimiter(0.001, 1))
+
+	first := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 5353, Zone: "eth0"}
+	if m := exchangeFrom(first, newQuery("first.question", dns.TypeTXT)); m == nil || m.Rcode != dns.RcodeSuccess {
+		t.Fatalf("first query got %v, want NOERROR", m)
+	}
+	// The same client from another port and interface is still over its budget
+	again := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 5454, Zone: "eth1"}
+	if m := exchangeFrom(again, newQuery("second.question", dns.TypeTXT)); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("same client on another zone got %v, want REFUSED", m)
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 5353, Zone: "eth0"}
+	if m := exchangeFrom(other, newQuery("first.question", dns.TypeTXT)); m == nil || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("another IPv6 client got %v, want NOERROR", m)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+)
+
+// reloadableFiles are the configuration files SIGHUP re-reads, empty for ones that aren't set
+type reloadableFiles struct {
+	prompt    string
+	blocklist string
+	cname     string
+	knowledge string
+	allow     string
+}
+
+// reloadConfig re-reads every file in files, swapping in each one that loads and logging whether it changed.
+// A file that fails to load keeps its old contents, so a typo can't take away a working configuration.
+func reloadConfig(files reloadableFiles) {
+	if files.prompt != "" {
+		if prompt, err := loadSystemPrompt(files.prompt); err != nil {
+			logger.Error("Failed to reload prompt file, keeping the old one", "file", files.prompt, "error", err)
+		} else {
+			// A new prompt changes every cache key, so answers generated under the old one stop being served
+			changed := prompt != currentSystemPrompt()
+			systemPrompt.Store(&prompt)
+			logger.Info("Reloaded prompt file", "file", files.prompt, "changed", changed)
+		}
+	}
+
+	if files.blocklist != "" {
+		if b, err := loadBlocklistFile(files.blocklist); err != nil {
+			logger.Error("Failed to reload blocklist file, keeping the old one", "file", files.blocklist, "error", err)
+		} else {
+			old := promptBlocklist.Swap(b)
+			logger.Info("Reloaded blocklist file", "file", files.blocklist, "changed", !b.equal(old), "patterns", b.len(), "previous_patterns", old.len())
+		}
+	}
+
+	if files.cname != "" {
+		if targets, err := loadCNAMEFile(files.cname); err != nil {
+			logger.Error("Failed to reload CNAME file, keeping the old one", "file", files.cname, "error", err)
+		} else {
+			old := cnameTargets.Swap(&targets)
+			logger.Info("Reloaded CNAME file", "file", files.cname, "changed", old == nil || !maps.Equal(*old, targets), "entries", len(targets))
+		}
+	}
+
+	if files.knowledge != "" {
+		if answers, err := loadKnowledgeFile(files.knowledge); err != nil {
+			logger.Error("Failed to reload knowledge file, keeping the old one", "file", files.knowledge, "error", err)
+		} else {
+			old := knowledgeBase.Swap(&answers)
+			logger.Info("Reloaded knowledge file", "file", files.knowledge, "changed", old == nil || !maps.Equal(*old, answers), "answers", len(answers))
+		}
+	}
+
+	if files.allow != "" {
+		if nets, err := loadAllowFile(files.allow); err != nil {
+			logger.Error("Failed to reload allow file, keeping the old one", "file", files.allow, "error", err)
+		} else {
+			old := allowNets.Swap(&nets)
+			changed := old == nil || !slices.EqualFunc(*old, nets, func(x, y *net.IPNet) bool { return x.String() == y.String() })
+			logger.Info("Reloaded allow file", "file", files.allow, "changed", changed, "networks", len(nets))
+		}
+	}
+}
+
+// equal reports whether b and other hold the same patterns in the same order
+func (b *blocklist) equal(other *blocklist) bool {
+	if b == nil || other == nil {
+		return b == other
+	}
+	return slices.Equal(b.substrings, other.substrings) &&
+		slices.EqualFunc(b.regexps, other.regexps, func(x, y *regexp.Regexp) bool { return x.String() == y.String() })
+}
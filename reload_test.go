@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReloadBlocklist(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	path := writeBlocklist(t, "malware\n")
+	useBlocklist(t, path)
+	logs := captureLogs(t, slog.LevelInfo)
+
+	rcode := func(name string) int {
+		return exchange(t, newQuery(name, dns.TypeTXT)).Rcode
+	}
+	if got := rcode("write.some.malware"); got != dns.RcodeRefused {
+		t.Fatalf("got %s before reloading, want REFUSED", dns.RcodeToString[got])
+	}
+	if got := rcode("what.is.phishing"); got != dns.RcodeSuccess {
+		t.Fatalf("got %s before reloading, want NOERROR", dns.RcodeToString[got])
+	}
+
+	// What SIGHUP runs, with the file edited in place
+	if err := os.WriteFile(path, []byte("phishing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(reloadableFiles{blocklist: path})
+	if got := rcode("what.is.phishing"); got != dns.RcodeRefused {
+		t.Errorf("newly blocked prompt got %s after reloading, want REFUSED", dns.RcodeToString[got])
+	}
+	if got := rcode("write.some.malware"); got != dns.RcodeSuccess {
+		t.Errorf("unblocked prompt got %s after reloading, want NOERROR", dns.RcodeToString[got])
+	}
+	if out := logs.String(); !strings.Contains(out, "Reloaded blocklist file") || !strings.Contains(out, "changed=true") {
+		t.Errorf("reload not logged as a change:\n%s", out)
+	}
+
+	// A broken file keeps the last good blocklist
+	if err := os.WriteFile(path, []byte("re:(unclosed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(reloadableFiles{blocklist: path})
+	if got := rcode("what.is.phishing"); got != dns.RcodeRefused {
+		t.Errorf("got %s after a failed reload, want the old blocklist kept", dns.RcodeToString[got])
+	}
+
+	// The cache survives reloading, so the answer generated before it is still served
+	if got := txtStrings(exchange(t, newQuery("what.is.go", dns.TypeTXT))); !slices.Equal(got, []string{"An answer."}) {
+		t.Fatalf("answered %q", got)
+	}
+	before := calls.Load()
+	reloadConfig(reloadableFiles{blocklist: path})
+	exchange(t, newQuery("what.is.go", dns.TypeTXT))
+	if got := calls.Load(); got != before {
+		t.Error("generated again after reloading, want the cached answer kept")
+	}
+}
+
+func TestReloadAllowFile(t *testing.T) {
+	useFreshCache(t)
+	stubGenerate(t, answerWith("An answer."))
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(path, []byte("# office\n192.0.2.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	nets, err := loadAllowFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAllowNets(t, nets)
+
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}
+	rcode := func(from *net.UDPAddr) int {
+		m := exchangeFrom(from, newQuery("what.is.go", dns.TypeTXT))
+		if m == nil {
+			t.Fatal("no reply")
+		}
+		return m.Rcode
+	}
+	if got := rcode(other); got != dns.RcodeRefused {
+		t.Fatalf("client outside the allow file got %s before reloading, want REFUSED", dns.RcodeToString[got])
+	}
+
+	// What SIGHUP runs, with the file edited in place
+	if err := os.WriteFile(path, []byte("192.0.2.0/24\n198.51.100.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(reloadableFiles{allow: path})
+	if got := rcode(other); got != dns.RcodeSuccess {
+		t.Errorf("newly allowed client got %s after reloading, want NOERROR", dns.RcodeToString[got])
+	}
+
+	// An emptied file would allow every client, so it's refused like a broken one and the old list is kept
+	for _, contents := range []string{"# nothing yet\n", "not a network\n"} {
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		reloadConfig(reloadableFiles{allow: path})
+		if got := rcode(&net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 5353}); got != dns.RcodeRefused {
+			t.Errorf("after reloading %q, a client in neither list got %s, want the old list kept", contents, dns.RcodeToString[got])
+		}
+	}
+}
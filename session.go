@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultSessionTurns  = 5
+	defaultSessionTTL    = 30 * time.Minute
+	sessionPurgeInterval = 1 * time.Minute
+)
+
+// sessionTurn is one question and answer in a conversation
+type sessionTurn struct {
+	question string
+	answer   string
+	// prompt is the full prompt, including history, that produced the answer
+	prompt string
+}
+
+type session struct {
+	turns    []sessionTurn
+	lastUsed time.Time
+}
+
+var (
+	// sessionsEnabled treats the first label of a query as a session ID carrying conversation history
+	sessionsEnabled bool
+	sessionTurns    = defaultSessionTurns
+	sessionTTL      = defaultSessionTTL
+
+	sessions      = make(map[string]*session)
+	sessionsMutex = &sync.Mutex{}
+)
+
+// sessionPrompt returns the prompt for question within a session, with the previous turns prepended.
+// A repeat of the last question, like a DNS retry, gets the same prompt as before so it is served from
+// the cache rather than asked again with itself in the history. With -max-prompt-len, the oldest turns are
+// dropped until the prompt fits, as the limit is on what's sent to the LLM and not just the new question.
+func sessionPrompt(id, question string) string {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s, ok := sessions[id]
+	if !ok || len(s.turns) == 0 {
+		return question
+	}
+	s.lastUsed = time.Now()
+
+	last := s.turns[len(s.turns)-1]
+	if last.question == question {
+		return last.prompt
+	}
+
+	for turns := s.turns; len(turns) > 0; turns = turns[1:] {
+		prompt := historyPrompt(turns, question)
+		if maxPromptLen <= 0 || utf8.RuneCountInString(prompt) <= maxPromptLen {
+			return prompt
+		}
+	}
+	return question
+}
+
+// historyPrompt renders turns followed by question as a single prompt
+func historyPrompt(turns []sessionTurn, question string) string {
+	var b strings.Builder
+	b.WriteString("Previous conversation, ")
+	for _, t := range turns {
+		b.WriteString("User: " + t.question + " Assistant: " + t.answer + " ")
+	}
+	b.WriteString("Now answer, User: " + question)
+	return b.String()
+}
+
+// recordSessionTurn adds a completed turn to the session's history, keeping the last sessionTurns
+func recordSessionTurn(id, question, prompt, answer string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s, ok := sessions[id]
+	if !ok {
+		s = &session{}
+		sessions[id] = s
+	}
+	s.lastUsed = time.Now()
+
+	// Duplicate queries for the same turn all finish here, only the first is recorded
+	if len(s.turns) > 0 && s.turns[len(s.turns)-1].question == question {
+		return
+	}
+	s.turns = append(s.turns, sessionTurn{question: question, answer: answer, prompt: prompt})
+	if len(s.turns) > sessionTurns {
+		s.turns = s.turns[len(s.turns)-sessionTurns:]
+	}
+}
+
+// purgeIdleSessions removes sessions unused for longer than sessionTTL and returns how many were removed
+func purgeIdleSessions() int {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	removed := 0
+	for id, s := range sessions {
+		if time.Since(s.lastUsed) > sessionTTL {
+			delete(sessions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// runSessionPurger purges idle sessions every interval until ctx is cancelled
+func runSessionPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := purgeIdleSessions(); removed > 0 {
+				logger.Info("Purged idle sessions", "count", removed)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+)
+
+// useFreshSessions gives the test an empty session store of its own, with sessions enabled
+func useFreshSessions(t *testing.T) {
+	t.Helper()
+	setForTest(t, &sessionsEnabled, true)
+	setForTest(t, &sessions, make(map[string]*session))
+}
+
+func TestSessionCarriesPreviousTurn(t *testing.T) {
+	useFreshCache(t)
+	useFreshSessions(t)
+	var mu sync.Mutex
+	var prompts []string
+	stubGenerate(t, func(_ context.Context, q string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		prompts = append(prompts, q)
+		if strings.Contains(q, "Previous conversation") {
+			return []string{"It was created at Google."}, nil
+		}
+		return []string{"Go is a programming language."}, nil
+	})
+
+	first := exchange(t, newQuery("abc123.what.is.go", dns.TypeTXT))
+	if got := txtStrings(first); !slices.Equal(got, []string{"Go is a programming language."}) {
+		t.Fatalf("first turn got %q", got)
+	}
+	second := exchange(t, newQuery("abc123.who.made.it", dns.TypeTXT))
+	if got := txtStrings(second); !slices.Equal(got, []string{"It was created at Google."}) {
+		t.Fatalf("second turn got %q, want an answer given the history", got)
+	}
+
+	want := []string{
+		"what is go",
+		"Previous conversation, User: what is go Assistant: Go is a programming language. Now answer, User: who made it",
+	}
+	if !slices.Equal(prompts, want) {
+		t.Errorf("prompted with %q, want %q", prompts, want)
+	}
+
+	// A retry of the second turn is served from the cache, and another session starts afresh
+	exchange(t, newQuery("abc123.who.made.it", dns.TypeTXT))
+	exchange(t, newQuery("XYZ789.who.made.it", dns.TypeTXT))
+	if len(prompts) != 3 || prompts[2] != "who made it" {
+		t.Errorf("prompted with %q, want a retry cached and the new session without history", prompts)
+	}
+}
+
+func TestSessionKeepsLastTurns(t *testing.T) {
+	useFreshSessions(t)
+	setForTest(t, &sessionTurns, 2)
+	for _, q := range []string{"one", "two", "three"} {
+		recordSessionTurn("s", q, q, "answer "+q)
+	}
+	got := sessionPrompt("s", "four")
+	if strings.Contains(got, "User: one") || !strings.Contains(got, "User: two") || !strings.Contains(got, "User: three") {
+		t.Errorf("got prompt %q, want only the last 2 turns", got)
+	}
+}
+
+func TestSessionHistoryIsTrimmedToMaxPromptLen(t *testing.T) {
+	useFreshSessions(t)
+	setForTest(t, &maxPromptLen, 100)
+	for _, q := range []string{"one", "two", "three"} {
+		recordSessionTurn("s", q, q, "answer "+q)
+	}
+	got := sessionPrompt("s", "four")
+	if utf8.RuneCountInString(got) > maxPromptLen {
+		t.Errorf("got a prompt of %d characters, want at most %d", utf8.RuneCountInString(got), maxPromptLen)
+	}
+	if strings.Contains(got, "User: one") || !strings.Contains(got, "User: three") || !strings.HasSuffix(got, "User: four") {
+		t.Errorf("got prompt %q, want the oldest turns dropped first", got)
+	}
+
+	// A question leaving no room for any history is asked on its own
+	question := strings.Repeat("x", 90)
+	if got := sessionPrompt("s", question); got != question {
+		t.Errorf("got prompt %q, want the question alone", got)
+	}
+}
+
+func TestIdleSessionsArePurged(t *testing.T) {
+	useFreshSessions(t)
+	setForTest(t, &sessionTTL, time.Minute)
+	recordSessionTurn("idle", "q", "q", "a")
+	recordSessionTurn("active", "q", "q", "a")
+	sessions["idle"].lastUsed = time.Now().Add(-2 * time.Minute)
+
+	if removed := purgeIdleSessions(); removed != 1 {
+		t.Errorf("purged %d sessions, want 1", removed)
+	}
+	if _, ok := sessions["active"]; !ok {
+		t.Error("purged an active session")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// staticTTL is the TTL for records that don't come from the LLM and rarely change
+const staticTTL = 300
+
+var (
+	// aRecord and aaaaRecord are returned for A and AAAA queries at the zone apex, nil when unset
+	aRecord    net.IP
+	aaaaRecord net.IP
+
+	// cnameTargets maps lowercased prompts to the canonical name they redirect to, swapped whole when the file
+	// is reloaded, nil when unset
+	cnameTargets atomic.Pointer[map[string]string]
+)
+
+// inZone reports whether name is in the zone we answer for, any name counts when no zone is configured
+func inZone(name string) bool {
+	return zone == "" || dns.IsSubDomain(zone, name)
+}
+
+// isApex reports whether name is the zone apex, any name counts when no zone is configured
+func isApex(name string) bool {
+	return zone == "" || dns.CanonicalName(name) == dns.CanonicalName(zone)
+}
+
+// staticAddressRecord returns the configured A or AAAA record answering q, or nil if there isn't one
+func staticAddressRecord(q dns.Question) dns.RR {
+	if !isApex(q.Name) {
+		return nil
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: staticTTL}
+	switch {
+	case q.Qtype == dns.TypeA && aRecord != nil:
+		return &dns.A{Hdr: hdr, A: aRecord}
+	case q.Qtype == dns.TypeAAAA && aaaaRecord != nil:
+		return &dns.AAAA{Hdr: hdr, AAAA: aaaaRecord}
+	}
+	return nil
+}
+
+// loadCNAMEFile reads a JSON object mapping prompts, like "help", to the canonical names they redirect to
+func loadCNAMEFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]string, len(raw))
+	for prompt, target := range raw {
+		target = dns.Fqdn(target)
+		if _, ok := dns.IsDomainName(target); !ok {
+			return nil, fmt.Errorf("invalid target %q for %q", target, prompt)
+		}
+		targets[strings.ToLower(prompt)] = target
+	}
+	return targets, nil
+}
+
+// staticCNAMERecord returns a CNAME redirecting q if its decoded prompt is in cnameTargets, or nil otherwise
+func staticCNAMERecord(q dns.Question) dns.RR {
+	targets := cnameTargets.Load()
+	if targets == nil {
+		return nil
+	}
+	prompt, err := queryToPrompt(q.Name, zone, queryEncoding)
+	if err != nil {
+		return nil
+	}
+	target, ok := (*targets)[strings.ToLower(prompt)]
+	if !ok {
+		return nil
+	}
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: staticTTL},
+		Target: target,
+	}
+}
+
+// isApexLabel reports whether name is label directly under the zone apex, or the root without a zone
+func isApexLabel(name, label string) bool {
+	first, rest, ok := splitFirstLabel(name)
+	if !ok {
+		// A single label name is directly under the root
+		first, rest = strings.TrimSuffix(name, "."), "."
+	}
+	return strings.EqualFold(first, label) && (zone == "" && rest == "." || zone != "" && isApex(rest))
+}
+
+// aboutLabel is the label that, directly under the zone apex, asks for the identity record
+const aboutLabel = "_about"
+
+// aboutText describes the service in the identity record, empty means aboutDefaultText is used
+var aboutText string
+
+// aboutDefaultText names the service, its version when built as a module, and the model answering
+func aboutDefaultText() string {
+	text := "DNSChat"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		text += " " + info.Main.Version
+	}
+	if provider != nil {
+		text += ", model " + provider.Model()
+	}
+	return text
+}
+
+// staticAboutRecord returns the identity TXT record for TXT queries at the zone apex or its _about label, or nil
+// otherwise. Only _about is checked without a zone, as every name is then the apex.
+func staticAboutRecord(q dns.Question) dns.RR {
+	if q.Qtype != dns.TypeTXT {
+		return nil
+	}
+	if !isApexLabel(q.Name, aboutLabel) && (zone == "" || !isApex(q.Name)) {
+		return nil
+	}
+	text := cmp.Or(aboutText, aboutDefaultText())
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: staticTTL},
+		Txt: chunkString(text, txtMaxStringLen),
+	}
+}
+
+// SOA timers used unless overridden by flags, in seconds
+const (
+	defaultSOARefresh = 3600
+	defaultSOARetry   = 600
+	defaultSOAExpire  = 86400
+	defaultSOAMinTTL  = 300
+)
+
+// soaRecord is the zone's SOA, returned for SOA queries at the apex and in the authority section of
+// NXDOMAIN and NODATA replies so resolvers can cache them, nil when unset
+var soaRecord *dns.SOA
+
+// newSOARecord builds the SOA for zone, with mbox given as an email address or in DNS form
+func newSOARecord(zone, ns, mbox string, serial, refresh, retry, expire, minTTL uint32) (*dns.SOA, error) {
+	ns = dns.Fqdn(ns)
+	if _, ok := dns.IsDomainName(ns); !ok {
+		return nil, fmt.Errorf("invalid name server %q", ns)
+	}
+	// An email address like hostmaster@example.com is written hostmaster.example.com. in an SOA
+	mbox = dns.Fqdn(strings.Replace(mbox, "@", ".", 1))
+	if _, ok := dns.IsDomainName(mbox); !ok {
+		return nil, fmt.Errorf("invalid mailbox %q", mbox)
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: staticTTL},
+		Ns:      ns,
+		Mbox:    mbox,
+		Serial:  serial,
+		Refresh: refresh,
+		Retry:   retry,
+		Expire:  expire,
+		Minttl:  minTTL,
+	}, nil
+}
+
+// staticSOARecord returns the SOA answering q if it's an SOA query for the zone apex, or nil otherwise
+func staticSOARecord(q dns.Question) dns.RR {
+	if soaRecord == nil || q.Qtype != dns.TypeSOA || !isApex(q.Name) {
+		return nil
+	}
+	return soaRecord
+}
+
+// writeNegative replies to r with a NXDOMAIN or NODATA rcode, adding the SOA to the authority section for
+// names in the zone so resolvers know how long to cache the negative answer
+func writeNegative(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	m := newReply(r)
+	m.Rcode = rcode
+	if soaRecord != nil && m.Authoritative {
+		m.Ns = []dns.RR{soaRecord}
+	}
+	w.WriteMsg(m)
+}
+
+// nsNames are the zone's name servers, returned for NS queries at the apex, nil when unset
+var nsNames []string
+
+// parseNSList parses a comma separated list of name server names
+func parseNSList(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		name = dns.Fqdn(name)
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid name server %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// staticNSRecords returns the NS records answering q if it's an NS query for the zone apex, or nil otherwise
+func staticNSRecords(q dns.Question) []dns.RR {
+	if len(nsNames) == 0 || q.Qtype != dns.TypeNS || !isApex(q.Name) {
+		return nil
+	}
+	records := make([]dns.RR, 0, len(nsNames))
+	for _, name := range nsNames {
+		records = append(records, &dns.NS{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: staticTTL},
+			Ns:  name,
+		})
+	}
+	return records
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestInZone(t *testing.T) {
+	setForTest(t, &zone, "chat.example.com.")
+	for name, want := range map[string]bool{
+		"what.is.go.chat.example.com.": true,
+		"WHAT.IS.GO.Chat.Example.COM.": true,
+		"chat.example.com.":            true,
+		"google.com.":                  false,
+		"example.com.":                 false,
+		"notchat.example.com.":         false,
+		"chat.example.com.evil.org.":   false,
+	} {
+		if got := inZone(name); got != want {
+			t.Errorf("inZone(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	setForTest(t, &zone, "")
+	if !inZone("google.com.") {
+		t.Error("with no zone configured, got a name outside of it")
+	}
+}
+
+func TestQueriesOutsideZoneGetNXDOMAIN(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("An answer."))
+	setForTest(t, &zone, "chat.example.com.")
+
+	if m := exchange(t, newQuery("google.com", dns.TypeTXT)); m.Rcode != dns.RcodeNameError {
+		t.Errorf("out-of-zone query got %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for an out-of-zone query", got)
+	}
+	m := exchange(t, newQuery("what.is.go.chat.example.com", dns.TypeTXT))
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("in-zone query got %s with %d answers, want an answer", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+}
+
+func TestStaticAddressRecords(t *testing.T) {
+	setForTest(t, &zone, "Chat.Example.com.")
+	setForTest(t, &aRecord, net.ParseIP("192.0.2.10"))
+	setForTest(t, &aaaaRecord, net.ParseIP("2001:db8::10"))
+
+	m := exchange(t, newQuery("chat.example.com", dns.TypeA))
+	if len(m.Answer) != 1 {
+		t.Fatalf("A query got %d answers, want 1", len(m.Answer))
+	}
+	if a, ok := m.Answer[0].(*dns.A); !ok || !a.A.Equal(aRecord) || a.Hdr.Ttl != staticTTL || a.Hdr.Name != "chat.example.com." {
+		t.Errorf("A query got %v, want %s", m.Answer[0], aRecord)
+	}
+
+	m = exchange(t, newQuery("chat.example.com", dns.TypeAAAA))
+	if len(m.Answer) != 1 {
+		t.Fatalf("AAAA query got %d answers, want 1", len(m.Answer))
+	}
+	if aaaa, ok := m.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.Equal(aaaaRecord) {
+		t.Errorf("AAAA query got %v, want %s", m.Answer[0], aaaaRecord)
+	}
+
+	// Only the apex has an address, and only for a configured type
+	if m := exchange(t, newQuery("www.chat.example.com", dns.TypeA)); len(m.Answer) != 0 {
+		t.Errorf("A query below the apex got %v, want no answer", m.Answer)
+	}
+	setForTest(t, &aaaaRecord, nil)
+	if m := exchange(t, newQuery("chat.example.com", dns.TypeAAAA)); len(m.Answer) != 0 {
+		t.Errorf("AAAA query with no -aaaa-record got %v, want no answer", m.Answer)
+	}
+}
+
+// useCNAMETargets redirects prompts to targets until the test finishes
+func useCNAMETargets(t *testing.T, targets map[string]string) {
+	t.Helper()
+	old := cnameTargets.Load()
+	cnameTargets.Store(&targets)
+	t.Cleanup(func() { cnameTargets.Store(old) })
+}
+
+func TestCNAMERedirects(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("From the LLM."))
+	setForTest(t, &zone, "chat.example.com.")
+	path := filepath.Join(t.TempDir(), "cname.json")
+	if err := os.WriteFile(path, []byte(`{"Help": "docs.example.com", "get started": "start.example.com."}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := loadCNAMEFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useCNAMETargets(t, targets)
+
+	for name, want := range map[string]string{
+		"help.chat.example.com":        "docs.example.com.",
+		"HELP.chat.example.com":        "docs.example.com.",
+		"get.started.chat.example.com": "start.example.com.",
+	} {
+		// A CNAME applies whatever the type asked for
+		for _, qtype := range []uint16{dns.TypeTXT, dns.TypeA} {
+			m := exchange(t, newQuery(name, qtype))
+			if len(m.Answer) != 1 {
+				t.Errorf("%s %s: got %d answers, want a CNAME", name, dns.TypeToString[qtype], len(m.Answer))
+				continue
+			}
+			if cname, ok := m.Answer[0].(*dns.CNAME); !ok || cname.Target != want || cname.Hdr.Name != dns.Fqdn(name) {
+				t.Errorf("%s %s: got %v, want a CNAME to %s", name, dns.TypeToString[qtype], m.Answer[0], want)
+			}
+		}
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for redirected names", got)
+	}
+
+	// Anything else, including a prompt that only starts with a mapped one, falls through to the LLM
+	for _, name := range []string{"help.me.chat.example.com", "what.is.go.chat.example.com"} {
+		if got := txtStrings(exchange(t, newQuery(name, dns.TypeTXT))); !slices.Equal(got, []string{"From the LLM."}) {
+			t.Errorf("%s: got %q, want the LLM's answer", name, got)
+		}
+	}
+}
+
+func TestLoadCNAMEFileRejectsInvalidTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cname.json")
+	if err := os.WriteFile(path, []byte(`{"help": "not a..valid name"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCNAMEFile(path); err == nil {
+		t.Error("loaded an invalid target")
+	}
+}
+
+func TestIdentityRecord(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("From the LLM."))
+	setForTest(t, &zone, "chat.example.com.")
+	useProvider(t, &fakeProvider{model: "test-model"})
+
+	for _, name := range []string{"chat.example.com", "_about.chat.example.com", "_ABOUT.Chat.Example.Com"} {
+		m := exchange(t, newQuery(name, dns.TypeTXT))
+		if got := txtStrings(m); !slices.Equal(got, []string{"DNSChat, model test-model"}) {
+			t.Errorf("%s got %q, want the identity record", name, got)
+		}
+		if len(m.Answer) == 1 && m.Answer[0].Header().Ttl != staticTTL {
+			t.Errorf("%s has TTL %d, want %d", name, m.Answer[0].Header().Ttl, staticTTL)
+		}
+	}
+
+	setForTest(t, &aboutText, "Ask me anything over DNS.")
+	if got := txtStrings(exchange(t, newQuery("_about.chat.example.com", dns.TypeTXT))); !slices.Equal(got, []string{"Ask me anything over DNS."}) {
+		t.Errorf("got %q, want the configured -about text", got)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for identity queries", got)
+	}
+
+	// Only directly under the apex, deeper _about labels are questions like any other
+	if got := txtStrings(exchange(t, newQuery("_about.me.chat.example.com", dns.TypeTXT))); !slices.Equal(got, []string{"From the LLM."}) {
+		t.Errorf("deeper _about got %q, want the LLM's answer", got)
+	}
+}
+
+// useSOA configures an SOA for zone for the test
+func useSOA(t *testing.T, zone string) *dns.SOA {
+	t.Helper()
+	soa, err := newSOARecord(zone, "ns1.example.com", "hostmaster@example.com", 2026101401, defaultSOARefresh, defaultSOARetry, defaultSOAExpire, defaultSOAMinTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &soaRecord, soa)
+	return soa
+}
+
+func TestSOARecord(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("From the LLM."))
+	setForTest(t, &zone, "chat.example.com.")
+	setForTest(t, &nondataResponse, nondataNoData)
+	useSOA(t, "chat.example.com.")
+
+	m := exchange(t, newQuery("Chat.Example.com", dns.TypeSOA))
+	if len(m.Answer) != 1 || !m.Authoritative {
+		t.Fatalf("apex SOA query got %v, authoritative %v", m.Answer, m.Authoritative)
+	}
+	soa, ok := m.Answer[0].(*dns.SOA)
+	if !ok || soa.Ns != "ns1.example.com." || soa.Mbox != "hostmaster.example.com." || soa.Serial != 2026101401 {
+		t.Errorf("got %v, want the configured SOA", m.Answer[0])
+	}
+
+	// NODATA names the SOA in the authority section, so resolvers can cache it
+	for _, q := range []dns.Question{
+		{Name: "what.is.go.chat.example.com.", Qtype: dns.TypeMX},
+		{Name: "sub.chat.example.com.", Qtype: dns.TypeSOA},
+	} {
+		m := exchange(t, newQuery(q.Name, q.Qtype))
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+			t.Errorf("%s %s got %s with %d answers, want NODATA", q.Name, dns.TypeToString[q.Qtype], dns.RcodeToString[m.Rcode], len(m.Answer))
+		}
+		if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%s %s has authority %v, want the SOA", q.Name, dns.TypeToString[q.Qtype], m.Ns)
+		}
+	}
+
+	// Out-of-zone names aren't ours to vouch for
+	m = exchange(t, newQuery("example.org", dns.TypeMX))
+	if m.Rcode != dns.RcodeNameError || len(m.Ns) != 0 {
+		t.Errorf("out-of-zone query got %s with authority %v, want NXDOMAIN without the SOA", dns.RcodeToString[m.Rcode], m.Ns)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for SOA and NODATA queries", got)
+	}
+}
+
+func TestNSRecords(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("From the LLM."))
+	setForTest(t, &zone, "chat.example.com.")
+	setForTest(t, &nondataResponse, nondataNoData)
+	names, err := parseNSList(" ns1.example.com, ns2.example.net. ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &nsNames, names)
+
+	m := exchange(t, newQuery("chat.example.com", dns.TypeNS))
+	var got []string
+	for _, rr := range m.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			got = append(got, ns.Ns)
+		}
+	}
+	if !slices.Equal(got, []string{"ns1.example.com.", "ns2.example.net."}) || !m.Authoritative {
+		t.Errorf("apex NS query got %q, authoritative %v, want both name servers", got, m.Authoritative)
+	}
+
+	// Only the apex has name servers
+	if m := exchange(t, newQuery("sub.chat.example.com", dns.TypeNS)); len(m.Answer) != 0 {
+		t.Errorf("NS query below the apex got %v", m.Answer)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("generated %d times for NS queries", got)
+	}
+
+	if _, err := parseNSList("ns1.example.com,bad..name"); err == nil {
+		t.Error("parsed an invalid name server")
+	}
+}
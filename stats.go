@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsLabel is the label that, directly under the zone apex, asks for cache statistics
+const statsLabel = "_stats"
+
+var (
+	// statsQueryEnabled answers _stats queries from statsAllowNets, set in main
+	statsQueryEnabled bool
+	// statsAllowNets are the client networks that may query _stats
+	statsAllowNets []*net.IPNet
+)
+
+// isStatsQuery reports whether q asks for the _stats record
+func isStatsQuery(q dns.Question) bool {
+	if !statsQueryEnabled || q.Qtype != dns.TypeTXT {
+		return false
+	}
+	return isApexLabel(q.Name, statsLabel)
+}
+
+// statsRecord returns a TXT record describing the cache and in-flight generations, for debugging with dig
+func statsRecord(q dns.Question) dns.RR {
+	inFlightMutex.RLock()
+	inFlight := len(inFlightRequests)
+	inFlightMutex.RUnlock()
+
+	hits, misses := counterValue(cacheHitsTotal), counterValue(cacheMissesTotal)
+	hitRate := 0.0
+	if hits+misses > 0 {
+		hitRate = hits / (hits + misses)
+	}
+
+	return &dns.TXT{
+		// Stats change constantly, so resolvers shouldn't cache them
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+		Txt: []string{
+			cacheEntriesStat(),
+			fmt.Sprintf("cache_hits=%.0f", hits),
+			fmt.Sprintf("cache_misses=%.0f", misses),
+			fmt.Sprintf("cache_hit_rate=%.3f", hitRate),
+			fmt.Sprintf("inflight_generations=%d", inFlight),
+			fmt.Sprintf("queries=%.0f", counterValue(queriesTotal)),
+		},
+	}
+}
+
+// cacheEntriesStat reports the cache size, which only the memory backend knows cheaply
+func cacheEntriesStat() string {
+	if c, ok := responseCache.(interface{ Len() int }); ok {
+		return fmt.Sprintf("cache_entries=%d", c.Len())
+	}
+	return "cache_entries=unknown"
+}
+
+// counterValue reads the current value of a Prometheus counter
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStatsQuery(t *testing.T) {
+	useFreshCache(t)
+	calls := stubGenerate(t, answerWith("From the LLM."))
+	setForTest(t, &zone, "chat.example.com.")
+	setForTest(t, &statsQueryEnabled, true)
+	setForTest(t, &statsAllowNets, mustParseCIDRList(t, "192.0.2.0/24"))
+	exchange(t, newQuery("what.is.go.chat.example.com", dns.TypeTXT))
+
+	m := exchange(t, newQuery("_stats.chat.example.com", dns.TypeTXT))
+	strs := txtStrings(m)
+	if len(strs) == 0 || strs[0] != "cache_entries=1" {
+		t.Fatalf("got %q, want the stats starting with one cache entry", strs)
+	}
+	for _, prefix := range []string{"cache_hits=", "cache_misses=", "cache_hit_rate=", "inflight_generations=0", "queries="} {
+		if !strings.Contains(strings.Join(strs, " "), prefix) {
+			t.Errorf("stats %q missing %s", strs, prefix)
+		}
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != 0 {
+		t.Errorf("stats have TTL %d, want 0", ttl)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("generated %d times, want the stats query not to reach the LLM", got)
+	}
+
+	// Clients outside the allowed networks are refused
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5353}
+	if m := exchangeFrom(other, newQuery("_stats.chat.example.com", dns.TypeTXT)); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("disallowed client got %v, want REFUSED", m)
+	}
+
+	// Disabled, it's a question like any other
+	setForTest(t, &statsQueryEnabled, false)
+	if got := txtStrings(exchange(t, newQuery("_stats.chat.example.com", dns.TypeTXT))); len(got) != 1 || got[0] != "From the LLM." {
+		t.Errorf("with stats disabled got %q, want the LLM's answer", got)
+	}
+}